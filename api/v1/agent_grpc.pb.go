@@ -25,7 +25,27 @@ type AgentClient interface {
 	Insert(ctx context.Context, in *InsertRequest, opts ...grpc.CallOption) (*InsertResponse, error)
 	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
 	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchResponse, error)
+	Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error)
+	BatchInsert(ctx context.Context, in *BatchInsertRequest, opts ...grpc.CallOption) (*BatchInsertResponse, error)
+	BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...grpc.CallOption) (*BatchDeleteResponse, error)
+	BatchFetch(ctx context.Context, in *BatchFetchRequest, opts ...grpc.CallOption) (*BatchFetchResponse, error)
+	BatchInsertStream(ctx context.Context, opts ...grpc.CallOption) (Agent_BatchInsertStreamClient, error)
+	BatchDeleteStream(ctx context.Context, opts ...grpc.CallOption) (Agent_BatchDeleteStreamClient, error)
+	BatchFetchStream(ctx context.Context, opts ...grpc.CallOption) (Agent_BatchFetchStreamClient, error)
+	Range(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (Agent_RangeClient, error)
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Agent_WatchClient, error)
+	// With auth enabled a lease is owned by the user that granted it. Only
+	// its owner, root or a user allowed to write a key attached to it may
+	// keep it alive, revoking it also needs write access to every attached
+	// key.
+	LeaseGrant(ctx context.Context, in *LeaseGrantRequest, opts ...grpc.CallOption) (*LeaseGrantResponse, error)
+	LeaseRevoke(ctx context.Context, in *LeaseRevokeRequest, opts ...grpc.CallOption) (*LeaseRevokeResponse, error)
+	LeaseKeepAlive(ctx context.Context, opts ...grpc.CallOption) (Agent_LeaseKeepAliveClient, error)
+	LeaseTimeToLive(ctx context.Context, in *LeaseTimeToLiveRequest, opts ...grpc.CallOption) (*LeaseTimeToLiveResponse, error)
 	Memberlist(ctx context.Context, in *MemberlistRequest, opts ...grpc.CallOption) (*MemberlistResponse, error)
+	MemberlistV2(ctx context.Context, in *MemberlistV2Request, opts ...grpc.CallOption) (*MemberlistV2Response, error)
+	// WatchMemberlist sends the memberlist, then again whenever it changes.
+	WatchMemberlist(ctx context.Context, in *MemberlistV2Request, opts ...grpc.CallOption) (Agent_WatchMemberlistClient, error)
 }
 
 type agentClient struct {
@@ -63,6 +83,266 @@ func (c *agentClient) Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.
 	return out, nil
 }
 
+func (c *agentClient) Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error) {
+	out := new(TxnResponse)
+	err := c.cc.Invoke(ctx, "/agent.v1.Agent/Txn", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) BatchInsert(ctx context.Context, in *BatchInsertRequest, opts ...grpc.CallOption) (*BatchInsertResponse, error) {
+	out := new(BatchInsertResponse)
+	err := c.cc.Invoke(ctx, "/agent.v1.Agent/BatchInsert", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...grpc.CallOption) (*BatchDeleteResponse, error) {
+	out := new(BatchDeleteResponse)
+	err := c.cc.Invoke(ctx, "/agent.v1.Agent/BatchDelete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) BatchFetch(ctx context.Context, in *BatchFetchRequest, opts ...grpc.CallOption) (*BatchFetchResponse, error) {
+	out := new(BatchFetchResponse)
+	err := c.cc.Invoke(ctx, "/agent.v1.Agent/BatchFetch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) BatchInsertStream(ctx context.Context, opts ...grpc.CallOption) (Agent_BatchInsertStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Agent_ServiceDesc.Streams[0], "/agent.v1.Agent/BatchInsertStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentBatchInsertStreamClient{stream}
+	return x, nil
+}
+
+type Agent_BatchInsertStreamClient interface {
+	Send(*InsertRequest) error
+	CloseAndRecv() (*BatchInsertResponse, error)
+	grpc.ClientStream
+}
+
+type agentBatchInsertStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentBatchInsertStreamClient) Send(m *InsertRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *agentBatchInsertStreamClient) CloseAndRecv() (*BatchInsertResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(BatchInsertResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentClient) BatchDeleteStream(ctx context.Context, opts ...grpc.CallOption) (Agent_BatchDeleteStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Agent_ServiceDesc.Streams[1], "/agent.v1.Agent/BatchDeleteStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentBatchDeleteStreamClient{stream}
+	return x, nil
+}
+
+type Agent_BatchDeleteStreamClient interface {
+	Send(*DeleteRequest) error
+	CloseAndRecv() (*BatchDeleteResponse, error)
+	grpc.ClientStream
+}
+
+type agentBatchDeleteStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentBatchDeleteStreamClient) Send(m *DeleteRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *agentBatchDeleteStreamClient) CloseAndRecv() (*BatchDeleteResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(BatchDeleteResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentClient) BatchFetchStream(ctx context.Context, opts ...grpc.CallOption) (Agent_BatchFetchStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Agent_ServiceDesc.Streams[2], "/agent.v1.Agent/BatchFetchStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentBatchFetchStreamClient{stream}
+	return x, nil
+}
+
+type Agent_BatchFetchStreamClient interface {
+	Send(*FetchRequest) error
+	CloseAndRecv() (*BatchFetchResponse, error)
+	grpc.ClientStream
+}
+
+type agentBatchFetchStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentBatchFetchStreamClient) Send(m *FetchRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *agentBatchFetchStreamClient) CloseAndRecv() (*BatchFetchResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(BatchFetchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentClient) Range(ctx context.Context, in *RangeRequest, opts ...grpc.CallOption) (Agent_RangeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Agent_ServiceDesc.Streams[3], "/agent.v1.Agent/Range", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentRangeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Agent_RangeClient interface {
+	Recv() (*RangeResponse, error)
+	grpc.ClientStream
+}
+
+type agentRangeClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentRangeClient) Recv() (*RangeResponse, error) {
+	m := new(RangeResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Agent_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Agent_ServiceDesc.Streams[4], "/agent.v1.Agent/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Agent_WatchClient interface {
+	Recv() (*WatchResponse, error)
+	grpc.ClientStream
+}
+
+type agentWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentWatchClient) Recv() (*WatchResponse, error) {
+	m := new(WatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentClient) LeaseGrant(ctx context.Context, in *LeaseGrantRequest, opts ...grpc.CallOption) (*LeaseGrantResponse, error) {
+	out := new(LeaseGrantResponse)
+	err := c.cc.Invoke(ctx, "/agent.v1.Agent/LeaseGrant", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) LeaseRevoke(ctx context.Context, in *LeaseRevokeRequest, opts ...grpc.CallOption) (*LeaseRevokeResponse, error) {
+	out := new(LeaseRevokeResponse)
+	err := c.cc.Invoke(ctx, "/agent.v1.Agent/LeaseRevoke", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) LeaseKeepAlive(ctx context.Context, opts ...grpc.CallOption) (Agent_LeaseKeepAliveClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Agent_ServiceDesc.Streams[5], "/agent.v1.Agent/LeaseKeepAlive", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentLeaseKeepAliveClient{stream}
+	return x, nil
+}
+
+type Agent_LeaseKeepAliveClient interface {
+	Send(*LeaseKeepAliveRequest) error
+	Recv() (*LeaseKeepAliveResponse, error)
+	grpc.ClientStream
+}
+
+type agentLeaseKeepAliveClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentLeaseKeepAliveClient) Send(m *LeaseKeepAliveRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *agentLeaseKeepAliveClient) Recv() (*LeaseKeepAliveResponse, error) {
+	m := new(LeaseKeepAliveResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *agentClient) LeaseTimeToLive(ctx context.Context, in *LeaseTimeToLiveRequest, opts ...grpc.CallOption) (*LeaseTimeToLiveResponse, error) {
+	out := new(LeaseTimeToLiveResponse)
+	err := c.cc.Invoke(ctx, "/agent.v1.Agent/LeaseTimeToLive", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *agentClient) Memberlist(ctx context.Context, in *MemberlistRequest, opts ...grpc.CallOption) (*MemberlistResponse, error) {
 	out := new(MemberlistResponse)
 	err := c.cc.Invoke(ctx, "/agent.v1.Agent/Memberlist", in, out, opts...)
@@ -72,6 +352,47 @@ func (c *agentClient) Memberlist(ctx context.Context, in *MemberlistRequest, opt
 	return out, nil
 }
 
+func (c *agentClient) MemberlistV2(ctx context.Context, in *MemberlistV2Request, opts ...grpc.CallOption) (*MemberlistV2Response, error) {
+	out := new(MemberlistV2Response)
+	err := c.cc.Invoke(ctx, "/agent.v1.Agent/MemberlistV2", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *agentClient) WatchMemberlist(ctx context.Context, in *MemberlistV2Request, opts ...grpc.CallOption) (Agent_WatchMemberlistClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Agent_ServiceDesc.Streams[6], "/agent.v1.Agent/WatchMemberlist", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &agentWatchMemberlistClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Agent_WatchMemberlistClient interface {
+	Recv() (*MemberlistV2Response, error)
+	grpc.ClientStream
+}
+
+type agentWatchMemberlistClient struct {
+	grpc.ClientStream
+}
+
+func (x *agentWatchMemberlistClient) Recv() (*MemberlistV2Response, error) {
+	m := new(MemberlistV2Response)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // AgentServer is the server API for Agent service.
 // All implementations must embed UnimplementedAgentServer
 // for forward compatibility
@@ -79,7 +400,27 @@ type AgentServer interface {
 	Insert(context.Context, *InsertRequest) (*InsertResponse, error)
 	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
 	Fetch(context.Context, *FetchRequest) (*FetchResponse, error)
+	Txn(context.Context, *TxnRequest) (*TxnResponse, error)
+	BatchInsert(context.Context, *BatchInsertRequest) (*BatchInsertResponse, error)
+	BatchDelete(context.Context, *BatchDeleteRequest) (*BatchDeleteResponse, error)
+	BatchFetch(context.Context, *BatchFetchRequest) (*BatchFetchResponse, error)
+	BatchInsertStream(Agent_BatchInsertStreamServer) error
+	BatchDeleteStream(Agent_BatchDeleteStreamServer) error
+	BatchFetchStream(Agent_BatchFetchStreamServer) error
+	Range(*RangeRequest, Agent_RangeServer) error
+	Watch(*WatchRequest, Agent_WatchServer) error
+	// With auth enabled a lease is owned by the user that granted it. Only
+	// its owner, root or a user allowed to write a key attached to it may
+	// keep it alive, revoking it also needs write access to every attached
+	// key.
+	LeaseGrant(context.Context, *LeaseGrantRequest) (*LeaseGrantResponse, error)
+	LeaseRevoke(context.Context, *LeaseRevokeRequest) (*LeaseRevokeResponse, error)
+	LeaseKeepAlive(Agent_LeaseKeepAliveServer) error
+	LeaseTimeToLive(context.Context, *LeaseTimeToLiveRequest) (*LeaseTimeToLiveResponse, error)
 	Memberlist(context.Context, *MemberlistRequest) (*MemberlistResponse, error)
+	MemberlistV2(context.Context, *MemberlistV2Request) (*MemberlistV2Response, error)
+	// WatchMemberlist sends the memberlist, then again whenever it changes.
+	WatchMemberlist(*MemberlistV2Request, Agent_WatchMemberlistServer) error
 	mustEmbedUnimplementedAgentServer()
 }
 
@@ -96,9 +437,54 @@ func (UnimplementedAgentServer) Delete(context.Context, *DeleteRequest) (*Delete
 func (UnimplementedAgentServer) Fetch(context.Context, *FetchRequest) (*FetchResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Fetch not implemented")
 }
+func (UnimplementedAgentServer) Txn(context.Context, *TxnRequest) (*TxnResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Txn not implemented")
+}
+func (UnimplementedAgentServer) BatchInsert(context.Context, *BatchInsertRequest) (*BatchInsertResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchInsert not implemented")
+}
+func (UnimplementedAgentServer) BatchDelete(context.Context, *BatchDeleteRequest) (*BatchDeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchDelete not implemented")
+}
+func (UnimplementedAgentServer) BatchFetch(context.Context, *BatchFetchRequest) (*BatchFetchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchFetch not implemented")
+}
+func (UnimplementedAgentServer) BatchInsertStream(Agent_BatchInsertStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method BatchInsertStream not implemented")
+}
+func (UnimplementedAgentServer) BatchDeleteStream(Agent_BatchDeleteStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method BatchDeleteStream not implemented")
+}
+func (UnimplementedAgentServer) BatchFetchStream(Agent_BatchFetchStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method BatchFetchStream not implemented")
+}
+func (UnimplementedAgentServer) Range(*RangeRequest, Agent_RangeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Range not implemented")
+}
+func (UnimplementedAgentServer) Watch(*WatchRequest, Agent_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedAgentServer) LeaseGrant(context.Context, *LeaseGrantRequest) (*LeaseGrantResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LeaseGrant not implemented")
+}
+func (UnimplementedAgentServer) LeaseRevoke(context.Context, *LeaseRevokeRequest) (*LeaseRevokeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LeaseRevoke not implemented")
+}
+func (UnimplementedAgentServer) LeaseKeepAlive(Agent_LeaseKeepAliveServer) error {
+	return status.Errorf(codes.Unimplemented, "method LeaseKeepAlive not implemented")
+}
+func (UnimplementedAgentServer) LeaseTimeToLive(context.Context, *LeaseTimeToLiveRequest) (*LeaseTimeToLiveResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LeaseTimeToLive not implemented")
+}
 func (UnimplementedAgentServer) Memberlist(context.Context, *MemberlistRequest) (*MemberlistResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Memberlist not implemented")
 }
+func (UnimplementedAgentServer) MemberlistV2(context.Context, *MemberlistV2Request) (*MemberlistV2Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method MemberlistV2 not implemented")
+}
+func (UnimplementedAgentServer) WatchMemberlist(*MemberlistV2Request, Agent_WatchMemberlistServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchMemberlist not implemented")
+}
 func (UnimplementedAgentServer) mustEmbedUnimplementedAgentServer() {}
 
 // UnsafeAgentServer may be embedded to opt out of forward compatibility for this service.
@@ -166,6 +552,278 @@ func _Agent_Fetch_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Agent_Txn_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TxnRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).Txn(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agent.v1.Agent/Txn",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).Txn(ctx, req.(*TxnRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_BatchInsert_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchInsertRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).BatchInsert(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agent.v1.Agent/BatchInsert",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).BatchInsert(ctx, req.(*BatchInsertRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_BatchDelete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchDeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).BatchDelete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agent.v1.Agent/BatchDelete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).BatchDelete(ctx, req.(*BatchDeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_BatchFetch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchFetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).BatchFetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agent.v1.Agent/BatchFetch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).BatchFetch(ctx, req.(*BatchFetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_BatchInsertStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentServer).BatchInsertStream(&agentBatchInsertStreamServer{stream})
+}
+
+type Agent_BatchInsertStreamServer interface {
+	SendAndClose(*BatchInsertResponse) error
+	Recv() (*InsertRequest, error)
+	grpc.ServerStream
+}
+
+type agentBatchInsertStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentBatchInsertStreamServer) SendAndClose(m *BatchInsertResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *agentBatchInsertStreamServer) Recv() (*InsertRequest, error) {
+	m := new(InsertRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Agent_BatchDeleteStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentServer).BatchDeleteStream(&agentBatchDeleteStreamServer{stream})
+}
+
+type Agent_BatchDeleteStreamServer interface {
+	SendAndClose(*BatchDeleteResponse) error
+	Recv() (*DeleteRequest, error)
+	grpc.ServerStream
+}
+
+type agentBatchDeleteStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentBatchDeleteStreamServer) SendAndClose(m *BatchDeleteResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *agentBatchDeleteStreamServer) Recv() (*DeleteRequest, error) {
+	m := new(DeleteRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Agent_BatchFetchStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentServer).BatchFetchStream(&agentBatchFetchStreamServer{stream})
+}
+
+type Agent_BatchFetchStreamServer interface {
+	SendAndClose(*BatchFetchResponse) error
+	Recv() (*FetchRequest, error)
+	grpc.ServerStream
+}
+
+type agentBatchFetchStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentBatchFetchStreamServer) SendAndClose(m *BatchFetchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *agentBatchFetchStreamServer) Recv() (*FetchRequest, error) {
+	m := new(FetchRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Agent_Range_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RangeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServer).Range(m, &agentRangeServer{stream})
+}
+
+type Agent_RangeServer interface {
+	Send(*RangeResponse) error
+	grpc.ServerStream
+}
+
+type agentRangeServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentRangeServer) Send(m *RangeResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Agent_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServer).Watch(m, &agentWatchServer{stream})
+}
+
+type Agent_WatchServer interface {
+	Send(*WatchResponse) error
+	grpc.ServerStream
+}
+
+type agentWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentWatchServer) Send(m *WatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Agent_LeaseGrant_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeaseGrantRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).LeaseGrant(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agent.v1.Agent/LeaseGrant",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).LeaseGrant(ctx, req.(*LeaseGrantRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_LeaseRevoke_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeaseRevokeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).LeaseRevoke(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agent.v1.Agent/LeaseRevoke",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).LeaseRevoke(ctx, req.(*LeaseRevokeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_LeaseKeepAlive_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AgentServer).LeaseKeepAlive(&agentLeaseKeepAliveServer{stream})
+}
+
+type Agent_LeaseKeepAliveServer interface {
+	Send(*LeaseKeepAliveResponse) error
+	Recv() (*LeaseKeepAliveRequest, error)
+	grpc.ServerStream
+}
+
+type agentLeaseKeepAliveServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentLeaseKeepAliveServer) Send(m *LeaseKeepAliveResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *agentLeaseKeepAliveServer) Recv() (*LeaseKeepAliveRequest, error) {
+	m := new(LeaseKeepAliveRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Agent_LeaseTimeToLive_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LeaseTimeToLiveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).LeaseTimeToLive(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agent.v1.Agent/LeaseTimeToLive",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).LeaseTimeToLive(ctx, req.(*LeaseTimeToLiveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Agent_Memberlist_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(MemberlistRequest)
 	if err := dec(in); err != nil {
@@ -184,6 +842,45 @@ func _Agent_Memberlist_Handler(srv interface{}, ctx context.Context, dec func(in
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Agent_MemberlistV2_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MemberlistV2Request)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AgentServer).MemberlistV2(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/agent.v1.Agent/MemberlistV2",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AgentServer).MemberlistV2(ctx, req.(*MemberlistV2Request))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Agent_WatchMemberlist_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(MemberlistV2Request)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AgentServer).WatchMemberlist(m, &agentWatchMemberlistServer{stream})
+}
+
+type Agent_WatchMemberlistServer interface {
+	Send(*MemberlistV2Response) error
+	grpc.ServerStream
+}
+
+type agentWatchMemberlistServer struct {
+	grpc.ServerStream
+}
+
+func (x *agentWatchMemberlistServer) Send(m *MemberlistV2Response) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // Agent_ServiceDesc is the grpc.ServiceDesc for Agent service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -203,11 +900,80 @@ var Agent_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Fetch",
 			Handler:    _Agent_Fetch_Handler,
 		},
+		{
+			MethodName: "Txn",
+			Handler:    _Agent_Txn_Handler,
+		},
+		{
+			MethodName: "BatchInsert",
+			Handler:    _Agent_BatchInsert_Handler,
+		},
+		{
+			MethodName: "BatchDelete",
+			Handler:    _Agent_BatchDelete_Handler,
+		},
+		{
+			MethodName: "BatchFetch",
+			Handler:    _Agent_BatchFetch_Handler,
+		},
+		{
+			MethodName: "LeaseGrant",
+			Handler:    _Agent_LeaseGrant_Handler,
+		},
+		{
+			MethodName: "LeaseRevoke",
+			Handler:    _Agent_LeaseRevoke_Handler,
+		},
+		{
+			MethodName: "LeaseTimeToLive",
+			Handler:    _Agent_LeaseTimeToLive_Handler,
+		},
 		{
 			MethodName: "Memberlist",
 			Handler:    _Agent_Memberlist_Handler,
 		},
+		{
+			MethodName: "MemberlistV2",
+			Handler:    _Agent_MemberlistV2_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "BatchInsertStream",
+			Handler:       _Agent_BatchInsertStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "BatchDeleteStream",
+			Handler:       _Agent_BatchDeleteStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "BatchFetchStream",
+			Handler:       _Agent_BatchFetchStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Range",
+			Handler:       _Agent_Range_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Agent_Watch_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "LeaseKeepAlive",
+			Handler:       _Agent_LeaseKeepAlive_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "WatchMemberlist",
+			Handler:       _Agent_WatchMemberlist_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "api/v1/agent.proto",
 }
@@ -1,18 +1,26 @@
 package app
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+	v2 "github.com/izaakdale/dinghy-agent/api/v2"
+	"github.com/izaakdale/dinghy-agent/internal/certs"
 	"github.com/izaakdale/dinghy-agent/internal/discovery"
 	"github.com/izaakdale/dinghy-agent/internal/server"
+	"github.com/izaakdale/dinghy-agent/internal/tokens"
 	"github.com/kelseyhightower/envconfig"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/reflection"
 )
 
@@ -26,6 +34,61 @@ type Specification struct {
 	ClusterAddr   string `envconfig:"CLUSTER_ADDR"`
 	ClusterPort   string `envconfig:"CLUSTER_PORT"`
 	Name          string `envconfig:"NAME"`
+	ReadBalancer  string `envconfig:"READ_BALANCER" default:"round_robin"`
+	Shards        int    `envconfig:"SHARDS" default:"1"`
+	ShardSize     int    `envconfig:"SHARD_SIZE" default:"0"`
+	// WORKER_TLS_CA turns on tls to the workers, the rest is optional.
+	WorkerTLSCA         string        `envconfig:"WORKER_TLS_CA"`
+	WorkerTLSCert       string        `envconfig:"WORKER_TLS_CERT"`
+	WorkerTLSKey        string        `envconfig:"WORKER_TLS_KEY"`
+	WorkerTLSServerName string        `envconfig:"WORKER_TLS_SERVER_NAME"`
+	WorkerTLSSPIFFEID   string        `envconfig:"WORKER_TLS_SPIFFE_ID"`
+	CertReloadInterval  time.Duration `envconfig:"CERT_RELOAD_INTERVAL" default:"1m"`
+	// TLS_CERT and TLS_KEY turn on tls on the grpc listener. TLS_CA verifies
+	// client certificates and the other agents, TLS_CLIENT_AUTH is one of
+	// none, request or require. The agents forward requests to each other
+	// with TLS_CERT, so with client auth on it has to allow client use too.
+	// TLS_PEER_SERVER_NAME or TLS_PEER_SPIFFE_ID name what the agents'
+	// certificates show, requests forwarded by agents are only trusted from
+	// callers showing it.
+	TLSCert           string `envconfig:"TLS_CERT"`
+	TLSKey            string `envconfig:"TLS_KEY"`
+	TLSCA             string `envconfig:"TLS_CA"`
+	TLSClientAuth     string `envconfig:"TLS_CLIENT_AUTH" default:"none"`
+	TLSPeerServerName string `envconfig:"TLS_PEER_SERVER_NAME"`
+	TLSPeerSPIFFEID   string `envconfig:"TLS_PEER_SPIFFE_ID"`
+	// AUTH_ROOT_USERS are client certificate identities holding the root
+	// role, which sets up the other users through the Auth api.
+	AuthEnabled   bool     `envconfig:"AUTH_ENABLED"`
+	AuthRootUsers []string `envconfig:"AUTH_ROOT_USERS"`
+	// JWT_JWKS_FILE or JWT_KEY_FILES let clients authenticate with signed
+	// bearer tokens, and turn on auth. JWT_ROLE_MAP maps values of the roles
+	// claim to dinghy roles, as claim:role pairs. Unmapped values are dropped
+	// unless JWT_STRICT_ROLES is false, and root is never taken unmapped.
+	JWTJWKSFile    string            `envconfig:"JWT_JWKS_FILE"`
+	JWTKeyFiles    []string          `envconfig:"JWT_KEY_FILES"`
+	JWTIssuer      string            `envconfig:"JWT_ISSUER"`
+	JWTAudience    string            `envconfig:"JWT_AUDIENCE"`
+	JWTUserClaim   string            `envconfig:"JWT_USER_CLAIM" default:"sub"`
+	JWTRolesClaim  string            `envconfig:"JWT_ROLES_CLAIM" default:"roles"`
+	JWTRoleMap     map[string]string `envconfig:"JWT_ROLE_MAP"`
+	JWTStrictRoles bool              `envconfig:"JWT_STRICT_ROLES" default:"true"`
+	// SERF_ENCRYPT_KEYS are base64 gossip keys, the first encrypts. Rotated
+	// keys are kept in SERF_KEYRING_FILE, which wins over them once it exists.
+	SerfEncryptKeys  []string `envconfig:"SERF_ENCRYPT_KEYS"`
+	SerfKeyringFile  string   `envconfig:"SERF_KEYRING_FILE"`
+	SerfAllowedNames []string `envconfig:"SERF_ALLOWED_NAMES"`
+	// HEARTBEAT_KEYS are id:base64 HMAC keys workers seal heartbeats with.
+	// Once set, bare heartbeats are only accepted with HEARTBEAT_ALLOW_LEGACY.
+	// Workers do not seal heartbeats yet, so keys without it are refused.
+	HeartbeatKeys        map[string]string `envconfig:"HEARTBEAT_KEYS"`
+	HeartbeatAllowLegacy bool              `envconfig:"HEARTBEAT_ALLOW_LEGACY"`
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
 }
 
 func Run() {
@@ -43,43 +106,152 @@ func Run() {
 		log.Fatalf("failed to start up grpc listener: %v", err)
 	}
 
-	gsrv := grpc.NewServer()
+	picker, err := server.NewPicker(spec.ReadBalancer)
+	if err != nil {
+		log.Fatalf("failed to set up read balancing: %v", err)
+	}
+	var workerCreds credentials.TransportCredentials
+	if spec.WorkerTLSCA != "" {
+		r, err := certs.NewReloader(spec.WorkerTLSCert, spec.WorkerTLSKey, spec.WorkerTLSCA)
+		if err != nil {
+			log.Fatalf("failed to load worker tls certificates: %v", err)
+		}
+		go r.Run(context.Background(), spec.CertReloadInterval)
+		workerCreds = credentials.NewTLS(r.ClientConfig(certs.Identity{
+			ServerName: spec.WorkerTLSServerName,
+			SPIFFEID:   spec.WorkerTLSSPIFFEID,
+		}))
+	}
+	var serverCreds, peerCreds credentials.TransportCredentials
+	peerIdentity := certs.Identity{
+		ServerName: spec.TLSPeerServerName,
+		SPIFFEID:   spec.TLSPeerSPIFFEID,
+	}
+	if spec.TLSCert != "" {
+		clientAuth, ok := clientAuthTypes[spec.TLSClientAuth]
+		if !ok {
+			log.Fatalf("unknown TLS_CLIENT_AUTH %q", spec.TLSClientAuth)
+		}
+		if clientAuth != tls.NoClientCert && spec.TLSCA == "" {
+			log.Fatalf("TLS_CLIENT_AUTH %s needs TLS_CA", spec.TLSClientAuth)
+		}
+		r, err := certs.NewReloader(spec.TLSCert, spec.TLSKey, spec.TLSCA)
+		if err != nil {
+			log.Fatalf("failed to load tls certificates: %v", err)
+		}
+		go r.Run(context.Background(), spec.CertReloadInterval)
+		serverCreds = credentials.NewTLS(r.ServerConfig(clientAuth))
+		peerCreds = credentials.NewTLS(r.ClientConfig(peerIdentity))
+	}
+	var verifier *tokens.Verifier
+	if spec.JWTJWKSFile != "" || len(spec.JWTKeyFiles) > 0 {
+		verifier, err = tokens.NewVerifier(tokens.Config{
+			JWKSFile:   spec.JWTJWKSFile,
+			KeyFiles:   spec.JWTKeyFiles,
+			Issuer:     spec.JWTIssuer,
+			Audience:   spec.JWTAudience,
+			UserClaim:  spec.JWTUserClaim,
+			RolesClaim: spec.JWTRolesClaim,
+			RoleMap:    spec.JWTRoleMap,
+			Strict:     spec.JWTStrictRoles,
+		})
+		if err != nil {
+			log.Fatalf("failed to load token keys: %v", err)
+		}
+		go verifier.Run(context.Background(), spec.CertReloadInterval)
+	}
+	srv := server.New(server.Config{
+		Name:              spec.Name,
+		Picker:            picker,
+		Shards:            spec.Shards,
+		ShardSize:         spec.ShardSize,
+		WorkerCredentials: workerCreds,
+		PeerCredentials:   peerCreds,
+		PeerIdentity:      peerIdentity,
+		Auth:              spec.AuthEnabled || verifier != nil,
+		RootUsers:         spec.AuthRootUsers,
+		Tokens:            verifier,
+	})
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(srv.UnaryErrorInterceptor, srv.IdentityUnaryInterceptor, srv.ForwardUnaryInterceptor, srv.AuthUnaryInterceptor),
+		grpc.ChainStreamInterceptor(srv.StreamErrorInterceptor, srv.IdentityStreamInterceptor, srv.ForwardStreamInterceptor, srv.AuthStreamInterceptor),
+	}
+	if serverCreds != nil {
+		opts = append(opts, grpc.Creds(serverCreds))
+	}
+	gsrv := grpc.NewServer(opts...)
 	reflection.Register(gsrv)
 
-	srv := server.New()
 	v1.RegisterAgentServer(gsrv, srv)
+	v2.RegisterAgentServer(gsrv, srv.V2())
+	v1.RegisterAdminServer(gsrv, srv.Admin())
+	v1.RegisterAuthServer(gsrv, srv.Auth())
+
+	go srv.RunElection(context.Background())
+	go srv.RunRebalancer(context.Background())
 
 	errCh := make(chan error)
 	go func(ch chan error) {
 		ch <- gsrv.Serve(ln)
 	}(errCh)
 
+	events := &discovery.Events{
+		Keys:        make(map[string][]byte, len(spec.HeartbeatKeys)),
+		AllowLegacy: spec.HeartbeatAllowLegacy,
+	}
+	for id, k := range spec.HeartbeatKeys {
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			log.Fatalf("bad heartbeat key %s: %v", id, err)
+		}
+		events.Keys[id] = b
+	}
+	if err := events.Check(); err != nil {
+		log.Fatalf("bad heartbeat config: %v", err)
+	}
+
 	node, evCh, err := discovery.NewMembership(
 		spec.BindAddr,
 		spec.BindPort, // BIND defines where the agent listens for incoming connection, e.g. the pod IP
 		spec.AdvertiseAddr,
-		spec.AdvertisePort, // ADVERTISE defines where the agent is reachable, e.g. the service IP
+		spec.AdvertisePort, // ADVERTISE defines where this agent is reachable, e.g. the pod IP when running several agents
 		spec.ClusterAddr,
 		spec.ClusterPort, // CLUSTER is the address of a first agent, e.g. the service IP, since all servers are reachable here
 		spec.Name,
+		discovery.Gossip{
+			Keys:         spec.SerfEncryptKeys,
+			KeyringFile:  spec.SerfKeyringFile,
+			AllowedNames: spec.SerfAllowedNames,
+		},
+		discovery.Tag{Key: "type", Value: "agent"},
+		// other agents forward requests here, so advertise where we serve grpc
+		discovery.Tag{Key: "grpc_addr", Value: fmt.Sprintf("%s:%d", spec.AdvertiseAddr, spec.GRPCPort)},
 	)
 	defer node.Leave()
 	if err != nil {
 		log.Fatal(err)
 	}
+	srv.SetKeyring(discovery.NewKeyring(node))
 
 	shCh := make(chan os.Signal, 2)
 	signal.Notify(shCh, os.Interrupt, syscall.SIGTERM)
 	for {
 		select {
 		case <-shCh:
+			// hand the coordinator lease over rather than let it lapse
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := srv.ResignCoordinator(ctx); err != nil {
+				log.Printf("failed to give up the coordinator lease: %v", err)
+			}
+			cancel()
 			err := node.Leave()
 			if err != nil {
 				log.Fatalf("error leaving cluster %v", err)
 			}
 			os.Exit(1)
 		case e := <-evCh:
-			discovery.HandleSerfEvent(e, node, srv)
+			discovery.HandleSerfEvent(e, node, srv, events)
 		case err := <-errCh:
 			log.Fatalf("grpc server errored: %v", err)
 		}
@@ -0,0 +1,250 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate, key and CA bundle from disk, reloading them
+// when they change so rotated certificates are picked up without a restart.
+type Reloader struct {
+	certFile, keyFile, caFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// NewReloader loads the files, any of which may be empty when unused.
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) load() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load key pair: %w", err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("failed to read ca bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in ca bundle %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.pool, r.modTime = cert, pool, modTime
+	return nil
+}
+
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f == "" {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Run checks the files for changes every interval until ctx is done. A
+// failed reload keeps the previous certificates.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		modTime, err := r.latestModTime()
+		if err != nil {
+			log.Printf("failed to check certificates: %v\n", err)
+			continue
+		}
+		r.mu.RLock()
+		changed := !modTime.Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.load(); err != nil {
+			log.Printf("failed to reload certificates, keeping the old ones: %v\n", err)
+			continue
+		}
+		log.Printf("reloaded certificates from %s\n", r.certFile)
+	}
+}
+
+// Certificate returns the current certificate, nil when there is none.
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// CAs returns the current CA pool, nil when there is none.
+func (r *Reloader) CAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// Identity is what a peer's certificate has to show. With SPIFFEID set the
+// certificate must carry that URI SAN, a trailing * matches any suffix.
+// Otherwise it must be valid for ServerName, or for the dialled host when
+// ServerName is empty.
+type Identity struct {
+	ServerName string
+	SPIFFEID   string
+}
+
+// ClientConfig returns a config for dialling servers with a certificate
+// signed by the CA bundle and showing id. The bundle and client certificate
+// are read at each handshake so reloads apply to new connections.
+func (r *Reloader) ClientConfig(id Identity) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: id.ServerName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := r.Certificate(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+		// the chain is verified against the current bundle below rather than
+		// a RootCAs fixed when the config was built
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			leaf, err := r.verifyChain(cs.PeerCertificates, x509.ExtKeyUsageServerAuth)
+			if err != nil {
+				return err
+			}
+			return id.check(leaf, cs.ServerName)
+		},
+	}
+}
+
+// ServerConfig returns a config serving the current certificate. clientAuth
+// is one of tls.NoClientCert, tls.VerifyClientCertIfGiven or
+// tls.RequireAndVerifyClientCert, client certificates are verified against
+// the current bundle like in ClientConfig.
+func (r *Reloader) ServerConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert := r.Certificate(); cert != nil {
+				return cert, nil
+			}
+			return nil, fmt.Errorf("no server certificate loaded")
+		},
+	}
+	switch clientAuth {
+	case tls.NoClientCert:
+		return cfg
+	case tls.RequireAndVerifyClientCert, tls.RequireAnyClientCert:
+		cfg.ClientAuth = tls.RequireAnyClientCert
+	default:
+		cfg.ClientAuth = tls.RequestClientCert
+	}
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return nil
+		}
+		_, err := r.verifyChain(cs.PeerCertificates, x509.ExtKeyUsageClientAuth)
+		return err
+	}
+	return cfg
+}
+
+// verifyChain checks a peer's chain against the current bundle, returning
+// its leaf.
+func (r *Reloader) verifyChain(chain []*x509.Certificate, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("peer presented no certificate")
+	}
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         r.CAs(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}); err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+// check reports whether leaf shows the identity, dialled is the host used
+// when ServerName is empty.
+func (id Identity) check(leaf *x509.Certificate, dialled string) error {
+	if id.SPIFFEID != "" {
+		for _, u := range leaf.URIs {
+			if matchSPIFFE(id.SPIFFEID, u.String()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("peer certificate does not carry %s", id.SPIFFEID)
+	}
+	name := id.ServerName
+	if name == "" {
+		name = dialled
+	}
+	return leaf.VerifyHostname(name)
+}
+
+// Matches reports whether a verified client certificate shows the identity.
+// Without a server name or spiffe id nothing matches, there is no dialled
+// host to fall back on.
+func (id Identity) Matches(leaf *x509.Certificate) bool {
+	if id.ServerName == "" && id.SPIFFEID == "" {
+		return false
+	}
+	return id.check(leaf, "") == nil
+}
+
+func matchSPIFFE(pattern, id string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(id, prefix)
+	}
+	return id == pattern
+}
@@ -0,0 +1,60 @@
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Peer is who a client certificate says the caller is.
+type Peer struct {
+	Subject    string `json:"subject,omitempty"`
+	CommonName string `json:"common_name,omitempty"`
+	// SPIFFEID is the certificate's spiffe:// URI SAN, if it has one.
+	SPIFFEID string   `json:"spiffe_id,omitempty"`
+	DNSNames []string `json:"dns_names,omitempty"`
+}
+
+// PeerOf returns the identity shown by cert.
+func PeerOf(cert *x509.Certificate) Peer {
+	p := Peer{
+		Subject:    cert.Subject.String(),
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+	}
+	for _, u := range cert.URIs {
+		if strings.EqualFold(u.Scheme, "spiffe") {
+			p.SPIFFEID = u.String()
+			break
+		}
+	}
+	return p
+}
+
+// PeerFromContext returns the identity of the client certificate the caller
+// of a grpc handler presented, false when the call came without one. The
+// certificate was verified during the handshake.
+func PeerFromContext(ctx context.Context) (Peer, bool) {
+	leaf, ok := LeafFromContext(ctx)
+	if !ok {
+		return Peer{}, false
+	}
+	return PeerOf(leaf), true
+}
+
+// LeafFromContext returns the client certificate the caller of a grpc
+// handler presented, false when the call came without one.
+func LeafFromContext(ctx context.Context) (*x509.Certificate, bool) {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	info, ok := pr.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return nil, false
+	}
+	return info.State.PeerCertificates[0], true
+}
@@ -11,7 +11,12 @@ import (
 	"github.com/pkg/errors"
 )
 
-func NewMembership(bindAddr, bindPort, advertiseAddr, advertisePort, clusterAddr, clusterPort, name string) (*serf.Serf, chan serf.Event, error) {
+type Tag struct {
+	Key   string
+	Value string
+}
+
+func NewMembership(bindAddr, bindPort, advertiseAddr, advertisePort, clusterAddr, clusterPort, name string, gossip Gossip, tags ...Tag) (*serf.Serf, chan serf.Event, error) {
 	conf := serf.DefaultConfig()
 	conf.Init()
 
@@ -33,11 +38,30 @@ func NewMembership(bindAddr, bindPort, advertiseAddr, advertisePort, clusterAddr
 
 	conf.MemberlistConfig.ProtocolVersion = 3
 
+	keyring, err := gossip.keyring()
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyring != nil {
+		conf.MemberlistConfig.Keyring = keyring
+		conf.KeyringFile = gossip.KeyringFile
+	}
+	// serf also sets the merge delegate as memberlist's alive delegate, so
+	// the guard sees single joins and not only merges
+	conf.Merge = &memberGuard{allowedNames: gossip.AllowedNames}
+
 	// prevent annoying serf and memberlist logs
 	conf.MemberlistConfig.Logger = log.New(io.Discard, "", log.Flags())
 	conf.Logger = log.New(io.Discard, "", log.Flags())
 	conf.NodeName = name
 
+	t := make(map[string]string, len(tags)+1)
+	t["name"] = name
+	for _, tag := range tags {
+		t[tag.Key] = tag.Value
+	}
+	conf.Tags = t
+
 	evCh := make(chan serf.Event)
 	conf.EventCh = evCh
 
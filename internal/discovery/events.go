@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	agentApi "github.com/izaakdale/dinghy-agent/api/v1"
+	"github.com/izaakdale/dinghy-agent/internal/server"
+	v1 "github.com/izaakdale/dinghy-worker/api/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// heartbeatEvent carries a ServerHeartbeat sealed in an EventEnvelope.
+	heartbeatEvent = "heartbeat"
+	// legacyHeartbeatEvent carries a bare ServerHeartbeat, as sent by
+	// workers that predate envelopes.
+	legacyHeartbeatEvent = "leader-notification"
+
+	envelopeVersion = 1
+	// maxEventSkew bounds how old, or how far ahead, a sealed event may be.
+	maxEventSkew = time.Minute
+)
+
+var ErrBadEnvelope = errors.New("bad event envelope")
+
+// Events verifies the user events workers send through serf.
+type Events struct {
+	// Keys are the shared HMAC keys by id. Without keys envelopes cannot be
+	// opened and only legacy heartbeats are accepted.
+	Keys map[string][]byte
+	// AllowLegacy accepts bare heartbeats even though keys are set, while
+	// workers are moved over to envelopes.
+	AllowLegacy bool
+}
+
+// Check turns away a configuration that would drop every heartbeat. The
+// workers send bare heartbeats, none of them seal one yet, so keys are only
+// of use alongside AllowLegacy for now.
+func (ev *Events) Check() error {
+	if len(ev.Keys) > 0 && !ev.AllowLegacy {
+		return errors.New("heartbeat keys are set without allowing legacy heartbeats, workers do not seal heartbeats yet so none would be accepted")
+	}
+	return nil
+}
+
+// userEventHandlers dispatches serf user events by name.
+var userEventHandlers = map[string]func(ev *Events, e serf.UserEvent, node *serf.Serf, srv *server.BalancerServer) error{
+	heartbeatEvent:       handleHeartbeat,
+	legacyHeartbeatEvent: handleLegacyHeartbeat,
+}
+
+func handleUserEvent(ev *Events, e serf.UserEvent, node *serf.Serf, srv *server.BalancerServer) error {
+	h, ok := userEventHandlers[e.Name]
+	if !ok {
+		log.Printf("ignoring unknown user event %q\n", e.Name)
+		return nil
+	}
+	return h(ev, e, node, srv)
+}
+
+func handleHeartbeat(ev *Events, e serf.UserEvent, node *serf.Serf, srv *server.BalancerServer) error {
+	payload, err := ev.Open(e.Name, e.Payload)
+	if err != nil {
+		return err
+	}
+	return heartbeat(payload, node, srv)
+}
+
+func handleLegacyHeartbeat(ev *Events, e serf.UserEvent, node *serf.Serf, srv *server.BalancerServer) error {
+	if len(ev.Keys) > 0 && !ev.AllowLegacy {
+		return fmt.Errorf("ignoring unsealed heartbeat, envelopes are required")
+	}
+	return heartbeat(e.Payload, node, srv)
+}
+
+func heartbeat(payload []byte, node *serf.Serf, srv *server.BalancerServer) error {
+	var hb v1.ServerHeartbeat
+	if err := proto.Unmarshal(payload, &hb); err != nil {
+		return err
+	}
+	if err := checkHeartbeat(node, hb.Name, hb.GrpcAddr, hb.RaftAddr); err != nil {
+		return fmt.Errorf("ignoring heartbeat: %w", err)
+	}
+	srv.HeartbeatHandler(&hb)
+	return nil
+}
+
+// Seal wraps payload for the event name with the key keyID. It is the
+// reference encoder for workers sealing their events, Open undoes it.
+func (ev *Events) Seal(name, keyID string, payload []byte) ([]byte, error) {
+	key, ok := ev.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("no key %q", keyID)
+	}
+	env := &agentApi.EventEnvelope{
+		Version: envelopeVersion,
+		KeyId:   keyID,
+		SentAt:  timestamppb.Now(),
+		Payload: payload,
+	}
+	env.Mac = envelopeMAC(key, name, env)
+	return proto.Marshal(env)
+}
+
+// Open checks an envelope sent under the event name and returns its payload.
+func (ev *Events) Open(name string, b []byte) ([]byte, error) {
+	var env agentApi.EventEnvelope
+	if err := proto.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadEnvelope, err)
+	}
+	if env.Version != envelopeVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrBadEnvelope, env.Version)
+	}
+	key, ok := ev.Keys[env.KeyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrBadEnvelope, env.KeyId)
+	}
+	if !hmac.Equal(env.Mac, envelopeMAC(key, name, &env)) {
+		return nil, fmt.Errorf("%w: mac does not match", ErrBadEnvelope)
+	}
+	if skew := time.Since(env.SentAt.AsTime()); skew > maxEventSkew || skew < -maxEventSkew {
+		return nil, fmt.Errorf("%w: sent %s ago", ErrBadEnvelope, skew.Round(time.Second))
+	}
+	return env.Payload, nil
+}
+
+func envelopeMAC(key []byte, name string, env *agentApi.EventEnvelope) []byte {
+	mac := hmac.New(sha256.New, key)
+	field := func(b []byte) {
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(b)))
+		mac.Write(n[:])
+		mac.Write(b)
+	}
+	version := binary.BigEndian.AppendUint32(nil, env.Version)
+	sentAt := binary.BigEndian.AppendUint64(nil, uint64(env.SentAt.AsTime().UnixNano()))
+
+	field(version)
+	field([]byte(name))
+	field([]byte(env.KeyId))
+	field(sentAt)
+	field(env.Payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,86 @@
+package discovery
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	agentApi "github.com/izaakdale/dinghy-agent/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSealOpen(t *testing.T) {
+	ev := &Events{Keys: map[string][]byte{
+		"k1": []byte("0123456789abcdef0123456789abcdef"),
+		"k2": []byte("fedcba9876543210fedcba9876543210"),
+	}}
+	payload := []byte("heartbeat payload")
+
+	sealed, err := ev.Seal(heartbeatEvent, "k1", payload)
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+	got, err := ev.Open(heartbeatEvent, sealed)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("Open() = %q, want %q", got, payload)
+	}
+
+	if _, err := ev.Seal(heartbeatEvent, "k3", payload); err == nil {
+		t.Errorf("Seal() with an unknown key succeeded")
+	}
+
+	tamper := func(fn func(env *agentApi.EventEnvelope)) []byte {
+		var env agentApi.EventEnvelope
+		if err := proto.Unmarshal(sealed, &env); err != nil {
+			t.Fatal(err)
+		}
+		fn(&env)
+		b, err := proto.Marshal(&env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tests := []struct {
+		name  string
+		event string
+		b     []byte
+	}{
+		{"other event", legacyHeartbeatEvent, sealed},
+		{"payload changed", heartbeatEvent, tamper(func(env *agentApi.EventEnvelope) { env.Payload = []byte("forged") })},
+		{"other key id", heartbeatEvent, tamper(func(env *agentApi.EventEnvelope) { env.KeyId = "k2" })},
+		{"unknown key id", heartbeatEvent, tamper(func(env *agentApi.EventEnvelope) { env.KeyId = "k3" })},
+		{"other version", heartbeatEvent, tamper(func(env *agentApi.EventEnvelope) { env.Version++ })},
+		{"not an envelope", heartbeatEvent, []byte{0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ev.Open(tt.event, tt.b); !errors.Is(err, ErrBadEnvelope) {
+				t.Errorf("Open() error = %v, want %v", err, ErrBadEnvelope)
+			}
+		})
+	}
+}
+
+func TestEventsCheck(t *testing.T) {
+	keys := map[string][]byte{"k1": []byte("0123456789abcdef")}
+	tests := []struct {
+		name string
+		ev   Events
+		ok   bool
+	}{
+		{"no keys", Events{}, true},
+		{"keys with legacy", Events{Keys: keys, AllowLegacy: true}, true},
+		{"keys without legacy", Events{Keys: keys}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.ev.Check(); (err == nil) != tt.ok {
+				t.Errorf("Check() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -6,11 +6,22 @@ import (
 
 	"github.com/hashicorp/serf/serf"
 	"github.com/izaakdale/dinghy-agent/internal/server"
-	v1 "github.com/izaakdale/dinghy-worker/api/v1"
-	"google.golang.org/protobuf/proto"
 )
 
-func HandleSerfEvent(e serf.Event, node *serf.Serf, srv *server.BalancerServer) {
+func HandleSerfEvent(e serf.Event, node *serf.Serf, srv *server.BalancerServer, ev *Events) {
+	if me, ok := e.(serf.MemberEvent); ok {
+		for _, m := range me.Members {
+			if m.Tags["type"] != "worker" {
+				continue
+			}
+			status := m.Status.String()
+			if e.EventType() == serf.EventMemberReap {
+				status = "reaped"
+			}
+			srv.SetSerfStatus(m.Tags["name"], m.Tags["grpc_addr"], m.Tags["raft_addr"], status)
+		}
+	}
+
 	switch e.EventType() {
 	case serf.EventMemberJoin:
 		for _, member := range e.(serf.MemberEvent).Members {
@@ -37,7 +48,7 @@ func HandleSerfEvent(e serf.Event, node *serf.Serf, srv *server.BalancerServer)
 			}
 		}
 	case serf.EventUser:
-		err := handleCustomEvent(e.(serf.UserEvent), srv)
+		err := handleUserEvent(ev, e.(serf.UserEvent), node, srv)
 		if err != nil {
 			log.Printf("error handling custom event: %s", err.Error())
 		}
@@ -47,16 +58,10 @@ func HandleSerfEvent(e serf.Event, node *serf.Serf, srv *server.BalancerServer)
 func handleJoin(m serf.Member, srv *server.BalancerServer) error {
 	log.Printf("member joined %s @ %s\n", m.Name, m.Addr)
 
-	// pre-emtively adding types for expansion of agent
 	typeTag, ok := m.Tags["type"]
 	if !ok {
 		return fmt.Errorf("no type tag for incoming node")
 	}
-	if typeTag != "worker" {
-		// handle potential "agent" join here
-		return nil
-	}
-
 	nameTag, ok := m.Tags["name"]
 	if !ok {
 		return fmt.Errorf("no name tag for incoming node")
@@ -65,6 +70,15 @@ func handleJoin(m serf.Member, srv *server.BalancerServer) error {
 	if !ok {
 		return fmt.Errorf("no grpc_addr tag for incoming node")
 	}
+
+	switch typeTag {
+	case "worker":
+	case "agent":
+		return srv.AddPeer(nameTag, grpcTag)
+	default:
+		return nil
+	}
+
 	raftTag, ok := m.Tags["raft_addr"]
 	if !ok {
 		return fmt.Errorf("no raft_addr tag for incoming node")
@@ -82,18 +96,12 @@ func isLocal(c *serf.Serf, m serf.Member) bool {
 
 func handleLeave(m serf.Member, srv *server.BalancerServer) error {
 	log.Printf("member leaving %s @ %s\n", m.Name, m.Addr)
+	if m.Tags["type"] == "agent" {
+		return srv.RemovePeer(m.Name)
+	}
 	err := srv.RemoveClient(m.Name)
 	if err != nil {
 		return err
 	}
 	return nil
 }
-
-func handleCustomEvent(e serf.UserEvent, srv *server.BalancerServer) error {
-	var node v1.ServerHeartbeat
-	if err := proto.Unmarshal(e.Payload, &node); err != nil {
-		return err
-	}
-	srv.HeartbeatHandler(&node)
-	return nil
-}
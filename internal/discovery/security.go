@@ -0,0 +1,170 @@
+package discovery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/serf"
+	"github.com/izaakdale/dinghy-agent/internal/server"
+)
+
+// Gossip secures the serf cluster.
+type Gossip struct {
+	// Keys are base64 encoded encryption keys, the first one encrypts and
+	// all of them decrypt. Gossip is plaintext without keys.
+	Keys []string
+	// KeyringFile keeps the keyring across restarts once keys are rotated.
+	// When it exists it takes precedence over Keys.
+	KeyringFile string
+	// AllowedNames are path.Match patterns members' names have to match,
+	// any name is allowed when empty.
+	AllowedNames []string
+}
+
+func (g Gossip) keyring() (*memberlist.Keyring, error) {
+	keys := g.Keys
+	if g.KeyringFile != "" {
+		b, err := os.ReadFile(g.KeyringFile)
+		switch {
+		case err == nil:
+			keys = nil
+			if err := json.Unmarshal(b, &keys); err != nil {
+				return nil, fmt.Errorf("bad keyring file %s: %w", g.KeyringFile, err)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, err
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	raw := make([][]byte, len(keys))
+	for i, k := range keys {
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("bad gossip key: %w", err)
+		}
+		raw[i] = b
+	}
+	return memberlist.NewKeyring(raw, raw[0])
+}
+
+// memberGuard turns away members whose tags would mislead the agent, before
+// serf lets them into the cluster.
+type memberGuard struct {
+	allowedNames []string
+}
+
+// NotifyMerge checks every member serf is about to accept. Serf calls it both
+// when clusters merge and, through memberlist's alive delegate, for each
+// alive message, so a node joining on its own or changing its tags is
+// checked as well.
+func (g *memberGuard) NotifyMerge(members []*serf.Member) error {
+	for _, m := range members {
+		if err := g.validate(m); err != nil {
+			log.Printf("rejecting member %s @ %s: %v\n", m.Name, m.Addr, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *memberGuard) validate(m *serf.Member) error {
+	if len(g.allowedNames) > 0 {
+		allowed := false
+		for _, p := range g.allowedNames {
+			if ok, _ := path.Match(p, m.Name); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("name %s is not allowed", m.Name)
+		}
+	}
+	if m.Tags["name"] != m.Name {
+		return fmt.Errorf("name tag %q does not match the member name", m.Tags["name"])
+	}
+
+	required := []string{"grpc_addr"}
+	switch m.Tags["type"] {
+	case "agent":
+	case "worker":
+		required = append(required, "raft_addr")
+	default:
+		return fmt.Errorf("unknown member type %q", m.Tags["type"])
+	}
+	for _, tag := range required {
+		if _, _, err := net.SplitHostPort(m.Tags[tag]); err != nil {
+			return fmt.Errorf("bad %s tag %q: %v", tag, m.Tags[tag], err)
+		}
+	}
+	return nil
+}
+
+// serfKeyring rotates the gossip keys of the whole cluster through serf.
+type serfKeyring struct {
+	km *serf.KeyManager
+}
+
+// NewKeyring returns the keyring of the cluster node belongs to.
+func NewKeyring(node *serf.Serf) server.Keyring {
+	return &serfKeyring{km: node.KeyManager()}
+}
+
+func (k *serfKeyring) ListKeys() (*server.KeyringResult, error) {
+	return keyringResult(k.km.ListKeys())
+}
+
+func (k *serfKeyring) InstallKey(key string) (*server.KeyringResult, error) {
+	return keyringResult(k.km.InstallKey(key))
+}
+
+func (k *serfKeyring) UseKey(key string) (*server.KeyringResult, error) {
+	return keyringResult(k.km.UseKey(key))
+}
+
+func (k *serfKeyring) RemoveKey(key string) (*server.KeyringResult, error) {
+	return keyringResult(k.km.RemoveKey(key))
+}
+
+func keyringResult(resp *serf.KeyResponse, err error) (*server.KeyringResult, error) {
+	if resp == nil {
+		return nil, err
+	}
+	return &server.KeyringResult{
+		Keys:        resp.Keys,
+		PrimaryKeys: resp.PrimaryKeys,
+		Members:     resp.NumNodes,
+		Responses:   resp.NumResp,
+		Errors:      resp.NumErr,
+		Messages:    resp.Messages,
+	}, err
+}
+
+// checkHeartbeat makes sure a heartbeat comes from a live worker and repeats
+// the addresses the worker joined with, so a heartbeat cannot point the
+// agent somewhere else.
+func checkHeartbeat(node *serf.Serf, name, grpcAddr, raftAddr string) error {
+	for _, m := range node.Members() {
+		if m.Name != name {
+			continue
+		}
+		if m.Status != serf.StatusAlive || m.Tags["type"] != "worker" {
+			return fmt.Errorf("%s is not a live worker", name)
+		}
+		if m.Tags["grpc_addr"] != grpcAddr || m.Tags["raft_addr"] != raftAddr {
+			return fmt.Errorf("addresses of %s do not match its tags", name)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not a member", name)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	ErrMemberNotFound = errors.New("member not found")
+	// ErrMemberState is returned when a member is in the wrong state for a request.
+	ErrMemberState = errors.New("member cannot take this request")
+	// ErrUnsupported is returned for requests the workers have no api for.
+	ErrUnsupported = errors.New("not supported by the workers")
+)
+
+var _ v1.AdminServer = (*adminServer)(nil)
+
+// adminServer serves operator requests against the same BalancerServer that
+// serves clients.
+type adminServer struct {
+	v1.UnimplementedAdminServer
+	s *BalancerServer
+}
+
+func (s *BalancerServer) Admin() v1.AdminServer {
+	return &adminServer{s: s}
+}
+
+// SplitRange starts moving part of a range to another shard. The move runs in
+// the background, its progress is reported by RebalanceStatus. Nothing moves
+// while the key index is incomplete.
+func (a *adminServer) SplitRange(ctx context.Context, request *v1.SplitRangeRequest) (*v1.SplitRangeResponse, error) {
+	s := a.s
+	if err := s.ensureMeta(ctx); err != nil {
+		return nil, err
+	}
+
+	r, rt := s.routing(), s.routes.Load()
+	i := rt.rangeOf(request.Start)
+	if rt.ranges[i].start != request.Start {
+		return nil, fmt.Errorf("%w: no range starts at token %d", ErrInvalidRequest, request.Start)
+	}
+	if request.TargetShard == rt.ranges[i].shard || len(r.shardWorkers(request.TargetShard)) == 0 {
+		return nil, fmt.Errorf("%w: %q cannot take the range", ErrInvalidRequest, request.TargetShard)
+	}
+	at := request.SplitAt
+	if at == 0 {
+		var ok bool
+		if at, ok = medianToken(s.rangeKeys(rt)[i], request.Start); !ok {
+			return nil, fmt.Errorf("%w: too few keys to split at the median, set split_at", ErrInvalidRequest)
+		}
+	}
+	if at < request.Start || uint64(at) >= rt.end(i) {
+		return nil, fmt.Errorf("%w: token %d is outside the range", ErrInvalidRequest, at)
+	}
+	move := s.newMove(rt, i, at, request.TargetShard)
+
+	if err := s.startMove(ctx, move); err != nil {
+		return nil, err
+	}
+	go s.runMove(context.Background())
+
+	return &v1.SplitRangeResponse{Move: s.moveStatus()}, nil
+}
+
+func (a *adminServer) RebalanceStatus(ctx context.Context, request *v1.RebalanceStatusRequest) (*v1.RebalanceStatusResponse, error) {
+	s := a.s
+	rt := s.routes.Load()
+	rangeKeys := s.rangeKeys(rt)
+
+	resp := &v1.RebalanceStatusResponse{
+		Move:          s.moveStatus(),
+		IndexComplete: s.store.isComplete(),
+	}
+	if err := s.store.snapshotErr(); err != nil {
+		resp.IndexSnapshotError = err.Error()
+	}
+	for i, tr := range rt.ranges {
+		resp.Ranges = append(resp.Ranges, &v1.TokenRange{
+			Start: tr.start,
+			End:   rt.end(i),
+			Shard: tr.shard,
+			Keys:  int64(len(rangeKeys[i])),
+		})
+	}
+	return resp, nil
+}
+
+// CompleteIndex declares the key index complete, letting ranges move. The
+// caller vouches that no key is missing from it.
+func (a *adminServer) CompleteIndex(ctx context.Context, request *v1.CompleteIndexRequest) (*v1.CompleteIndexResponse, error) {
+	if err := a.s.ensureMeta(ctx); err != nil {
+		return nil, err
+	}
+	if err := a.s.completeIndex(ctx); err != nil {
+		return nil, err
+	}
+	return &v1.CompleteIndexResponse{}, nil
+}
+
+// ListMembers describes every worker, asking each for its raft state.
+func (a *adminServer) ListMembers(ctx context.Context, request *v1.ListMembersRequest) (*v1.ListMembersResponse, error) {
+	s := a.s
+	r := s.routing()
+	workers := make([]*Client, 0, len(r.workers))
+	for _, c := range r.workers {
+		workers = append(workers, c)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].ServerID < workers[j].ServerID
+	})
+
+	members := make([]*v1.Member, len(workers))
+	var wg sync.WaitGroup
+	for i, c := range workers {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+			members[i] = s.member(ctx, r, c)
+		}(i, c)
+	}
+	wg.Wait()
+	return &v1.ListMembersResponse{Members: members}, nil
+}
+
+// member describes a worker as r sees it.
+func (s *BalancerServer) member(ctx context.Context, r *routing, c *Client) *v1.Member {
+	m := &v1.Member{
+		Id:              c.ServerID,
+		GrpcAddr:        c.GRPCAddr,
+		RaftAddr:        c.RaftAddr,
+		Shard:           r.shardOf[c.ServerID],
+		Leader:          r.leads(c.ServerID),
+		Healthy:         c.health.healthy(),
+		Draining:        c.draining.Load(),
+		ConnectionState: c.conn.conn.GetState().String(),
+		// workers added from a heartbeat have not been seen by serf yet
+		SerfStatus: "alive",
+		Role:       "follower",
+	}
+	s.serfMu.Lock()
+	if sm, ok := s.serfMembers[c.ServerID]; ok {
+		m.SerfStatus = sm.status
+	}
+	s.serfMu.Unlock()
+	switch {
+	case m.Shard == "":
+		m.Role = "unassigned"
+	case m.Leader:
+		m.Role = "leader"
+	}
+	state, attempts, err := c.onboarding.snapshot()
+	m.OnboardingState = string(state)
+	m.OnboardingAttempts = int64(attempts)
+	if err != nil {
+		m.OnboardingError = err.Error()
+	}
+	if t := c.lastHeartbeat.Load(); t != 0 {
+		m.LastHeartbeat = timestamppb.New(time.Unix(0, t))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, leaderCallTimeout)
+	defer cancel()
+	if resp, err := c.RaftState(ctx, &workerApi.RaftStateRequest{}); err == nil {
+		m.RaftState = resp.State
+	}
+	return m
+}
+
+// RemoveMember cannot be served, the workers do not expose raft's
+// RemoveServer. Drain the member and stop it instead, serf tells the agents
+// it left.
+func (a *adminServer) RemoveMember(ctx context.Context, request *v1.RemoveMemberRequest) (*v1.RemoveMemberResponse, error) {
+	if _, err := a.s.workerByID(request.Id); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: workers cannot remove servers from their raft group", ErrUnsupported)
+}
+
+// TransferLeadership cannot be served, the workers do not expose raft's
+// LeadershipTransfer.
+func (a *adminServer) TransferLeadership(ctx context.Context, request *v1.TransferLeadershipRequest) (*v1.TransferLeadershipResponse, error) {
+	r := a.s.routing()
+	if len(r.shardWorkers(request.Shard)) == 0 {
+		return nil, fmt.Errorf("%w: shard %q", ErrMemberNotFound, request.Shard)
+	}
+	if request.To != "" {
+		if _, ok := r.workers[request.To]; !ok || r.shardOf[request.To] != request.Shard {
+			return nil, fmt.Errorf("%w: %q in shard %q", ErrMemberNotFound, request.To, request.Shard)
+		}
+	}
+	return nil, fmt.Errorf("%w: workers cannot transfer raft leadership", ErrUnsupported)
+}
+
+// PromoteLearner always fails for known members, workers join their raft
+// group as voters so there are no learners to promote.
+func (a *adminServer) PromoteLearner(ctx context.Context, request *v1.PromoteLearnerRequest) (*v1.PromoteLearnerResponse, error) {
+	if _, err := a.s.workerByID(request.Id); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: %s already votes, workers join as voters", ErrMemberState, request.Id)
+}
+
+// DrainMember takes a member out of read rotation, or puts it back. Leaders
+// cannot be drained since their leadership cannot be handed over.
+func (a *adminServer) DrainMember(ctx context.Context, request *v1.DrainMemberRequest) (*v1.DrainMemberResponse, error) {
+	s := a.s
+	c, err := s.workerByID(request.Id)
+	if err != nil {
+		return nil, err
+	}
+	r := s.routing()
+	if !request.Undrain && r.leads(c.ServerID) {
+		return nil, fmt.Errorf("%w: %s leads %s", ErrMemberState, c.ServerID, r.shardOf[c.ServerID])
+	}
+	c.draining.Store(!request.Undrain)
+	s.memberEvents.notify()
+	log.Printf("%s draining: %t\n", c.ServerID, !request.Undrain)
+	return &v1.DrainMemberResponse{Member: s.member(ctx, r, c)}, nil
+}
+
+func (s *BalancerServer) workerByID(serverID string) (*Client, error) {
+	c, ok := s.routing().workers[serverID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrMemberNotFound, serverID)
+	}
+	return c, nil
+}
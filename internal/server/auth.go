@@ -0,0 +1,482 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+	v2 "github.com/izaakdale/dinghy-agent/api/v2"
+	"github.com/izaakdale/dinghy-agent/internal/tokens"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// authKey holds the users and roles in the meta shard.
+	authKey = reservedPrefix + "auth"
+	// RootRole may read and write every key and use the Admin and Auth apis.
+	RootRole = "root"
+	// authRefresh is how long the agent trusts its copy of the auth data.
+	authRefresh = 5 * time.Second
+)
+
+var (
+	ErrUnauthenticated  = errors.New("no valid credentials")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrUserNotFound     = errors.New("user not found")
+	ErrRoleNotFound     = errors.New("role not found")
+)
+
+type permission struct {
+	Prefix string `json:"prefix"`
+	Read   bool   `json:"read,omitempty"`
+	Write  bool   `json:"write,omitempty"`
+}
+
+// covers reports whether every key in [start, end) starts with the prefix.
+func (p permission) covers(start, end string) bool {
+	if !strings.HasPrefix(start, p.Prefix) {
+		return false
+	}
+	pend := prefixEnd(p.Prefix)
+	if pend == "" {
+		return true
+	}
+	return end != "" && end <= pend
+}
+
+type authRole struct {
+	Permissions []permission `json:"permissions"`
+}
+
+type authUser struct {
+	Roles []string `json:"roles"`
+	// Tokens holds the sha256 of each of the user's bearer tokens.
+	Tokens []string `json:"tokens,omitempty"`
+}
+
+func (u *authUser) hasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// authData is the users and roles as stored under authKey.
+type authData struct {
+	Users map[string]*authUser `json:"users"`
+	Roles map[string]*authRole `json:"roles"`
+	// tokens maps token hashes to user names.
+	tokens map[string]string
+}
+
+func parseAuthData(val string) (*authData, error) {
+	d := &authData{}
+	if val != "" {
+		if err := json.Unmarshal([]byte(val), d); err != nil {
+			return nil, fmt.Errorf("bad auth data: %w", err)
+		}
+	}
+	if d.Users == nil {
+		d.Users = make(map[string]*authUser)
+	}
+	if d.Roles == nil {
+		d.Roles = make(map[string]*authRole)
+	}
+	d.tokens = make(map[string]string)
+	for name, u := range d.Users {
+		for _, h := range u.Tokens {
+			d.tokens[h] = name
+		}
+	}
+	return d, nil
+}
+
+// allowed reports whether one of the user's roles grants the access. A range
+// has to fall under a single permission.
+func (d *authData) allowed(u *authUser, a access) bool {
+	if u.hasRole(RootRole) {
+		return true
+	}
+	for _, name := range u.Roles {
+		role, ok := d.Roles[name]
+		if !ok {
+			continue
+		}
+		for _, p := range role.Permissions {
+			if (a.write && p.Write || !a.write && p.Read) && p.covers(a.start, a.end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authStore caches the auth data from the meta shard. Only the agent serving
+// a request checks it, so forwarded requests are checked by the coordinator.
+type authStore struct {
+	enabled bool
+	// rootUsers hold the root role without being stored, so a fresh cluster
+	// can be set up.
+	rootUsers map[string]bool
+	// verifier checks signed bearer tokens, nil when they are not accepted.
+	verifier *tokens.Verifier
+
+	mu     sync.Mutex
+	data   *authData
+	loaded time.Time
+}
+
+func newAuthStore(enabled bool, rootUsers []string, verifier *tokens.Verifier) *authStore {
+	as := &authStore{enabled: enabled, rootUsers: make(map[string]bool), verifier: verifier}
+	for _, u := range rootUsers {
+		as.rootUsers[u] = true
+	}
+	return as
+}
+
+// loadAuth returns the auth data, reading it again once authRefresh has passed.
+func (s *BalancerServer) loadAuth(ctx context.Context) (*authData, error) {
+	as := s.auth
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.data != nil && time.Since(as.loaded) < authRefresh {
+		return as.data, nil
+	}
+	val, _, err := s.fetchMeta(ctx, authKey)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseAuthData(val)
+	if err != nil {
+		return nil, err
+	}
+	as.data, as.loaded = d, time.Now()
+	return d, nil
+}
+
+// updateAuth applies fn to the latest auth data and stores the result.
+func (s *BalancerServer) updateAuth(ctx context.Context, fn func(d *authData) error) error {
+	as := s.auth
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	val, _, err := s.fetchMeta(ctx, authKey)
+	if err != nil {
+		return err
+	}
+	d, err := parseAuthData(val)
+	if err != nil {
+		return err
+	}
+	if err := fn(d); err != nil {
+		return err
+	}
+	if err := s.saveMeta(ctx, authKey, d); err != nil {
+		return err
+	}
+	// reparse so the token index follows the change
+	b, _ := json.Marshal(d)
+	if d, err = parseAuthData(string(b)); err != nil {
+		return err
+	}
+	as.data, as.loaded = d, time.Now()
+	return nil
+}
+
+// principal is the user a request is made as.
+type principal struct {
+	name string
+	user *authUser
+}
+
+type principalKey struct{}
+
+// authenticate finds the user behind a request, through its bearer token or
+// else its client certificate. Signed tokens carry their own roles, opaque
+// ones are looked up in the auth data.
+func (s *BalancerServer) authenticate(ctx context.Context) (*principal, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, v := range md.Get("authorization") {
+			token, ok := strings.CutPrefix(v, "Bearer ")
+			if !ok {
+				continue
+			}
+			if s.auth.verifier != nil && tokens.Looks(token) {
+				claims, err := s.auth.verifier.Verify(token)
+				if err != nil {
+					return nil, fmt.Errorf("%w: %v", ErrUnauthenticated, err)
+				}
+				return &principal{name: claims.User, user: &authUser{Roles: claims.Roles}}, nil
+			}
+			d, err := s.loadAuth(ctx)
+			if err != nil {
+				return nil, err
+			}
+			name, ok := d.tokens[hashToken(token)]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown bearer token", ErrUnauthenticated)
+			}
+			return &principal{name: name, user: d.Users[name]}, nil
+		}
+	}
+
+	caller, ok := Caller(ctx)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	var d *authData
+	for _, name := range []string{caller.SPIFFEID, caller.CommonName} {
+		if name == "" {
+			continue
+		}
+		if s.auth.rootUsers[name] {
+			return &principal{name: name, user: &authUser{Roles: []string{RootRole}}}, nil
+		}
+		if d == nil {
+			var err error
+			if d, err = s.loadAuth(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if u, ok := d.Users[name]; ok {
+			return &principal{name: name, user: u}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no user for the client certificate", ErrUnauthenticated)
+}
+
+// access is a read or write of the keys in [start, end).
+type access struct {
+	start, end string
+	write      bool
+}
+
+func keyAccess(key string, write bool) access {
+	start, end := keyBounds(key, "", false)
+	return access{start: start, end: end, write: write}
+}
+
+func rangeAccess(key, rangeEnd string, prefix bool) access {
+	start, end := keyBounds(key, rangeEnd, prefix)
+	return access{start: start, end: end}
+}
+
+// accesses lists the keys a request reads and writes. It returns false for
+// requests only root may make.
+func (s *BalancerServer) accesses(fullMethod string, req interface{}) ([]access, bool) {
+	if strings.HasPrefix(fullMethod, "/agent.v1.Admin/") {
+		return nil, false
+	}
+	if strings.HasPrefix(fullMethod, "/agent.v1.Auth/") {
+		_, ok := req.(*v1.WhoAmIRequest)
+		return nil, ok
+	}
+
+	switch r := req.(type) {
+	case *v1.InsertRequest:
+		return []access{keyAccess(r.Key, true)}, true
+	case *v2.InsertRequest:
+		return []access{keyAccess(r.Key, true)}, true
+	case *v1.DeleteRequest:
+		return []access{keyAccess(r.Key, true)}, true
+	case *v2.DeleteRequest:
+		return []access{keyAccess(r.Key, true)}, true
+	case *v1.FetchRequest:
+		return []access{keyAccess(r.Key, false)}, true
+	case *v2.FetchRequest:
+		return []access{keyAccess(r.Key, false)}, true
+	case *v1.RangeRequest:
+		return []access{rangeAccess(r.Key, r.RangeEnd, r.Prefix)}, true
+	case *v2.RangeRequest:
+		return []access{rangeAccess(r.Key, r.RangeEnd, r.Prefix)}, true
+	case *v1.WatchRequest:
+		return []access{rangeAccess(r.Key, r.RangeEnd, r.Prefix)}, true
+	case *v1.BatchInsertRequest:
+		var as []access
+		for _, item := range r.Items {
+			as = append(as, keyAccess(item.Key, true))
+		}
+		return as, true
+	case *v1.BatchDeleteRequest:
+		var as []access
+		for _, item := range r.Items {
+			as = append(as, keyAccess(item.Key, true))
+		}
+		return as, true
+	case *v1.BatchFetchRequest:
+		var as []access
+		for _, item := range r.Items {
+			as = append(as, keyAccess(item.Key, false))
+		}
+		return as, true
+	case *v1.TxnRequest:
+		var as []access
+		for _, c := range r.Compare {
+			as = append(as, keyAccess(c.Key, false))
+		}
+		for _, op := range append(append([]*v1.RequestOp{}, r.Success...), r.Failure...) {
+			switch o := op.Request.(type) {
+			case *v1.RequestOp_RequestInsert:
+				as = append(as, keyAccess(o.RequestInsert.Key, true))
+			case *v1.RequestOp_RequestDelete:
+				as = append(as, keyAccess(o.RequestDelete.Key, true))
+			case *v1.RequestOp_RequestFetch:
+				as = append(as, keyAccess(o.RequestFetch.Key, false))
+			}
+		}
+		return as, true
+	case *v1.LeaseTimeToLiveRequest:
+		if !r.Keys {
+			return nil, true
+		}
+		_, _, keys, _ := s.leases.timeToLive(r.Id)
+		var as []access
+		for _, key := range keys {
+			as = append(as, keyAccess(key, false))
+		}
+		return as, true
+	case *v1.LeaseGrantRequest:
+		// any authenticated user may grant a lease, they own it afterwards
+		return nil, true
+	case *v1.MemberlistRequest, *v1.MemberlistV2Request:
+		return nil, true
+	}
+	return nil, false
+}
+
+// authorize checks that the principal may make the request.
+func (s *BalancerServer) authorize(ctx context.Context, p *principal, fullMethod string, req interface{}) error {
+	switch r := req.(type) {
+	case *v1.LeaseKeepAliveRequest:
+		return s.authorizeLease(ctx, p, r.Id, false)
+	case *v1.LeaseRevokeRequest:
+		return s.authorizeLease(ctx, p, r.Id, true)
+	}
+
+	as, ok := s.accesses(fullMethod, req)
+	if !ok {
+		if p.user.hasRole(RootRole) {
+			return nil
+		}
+		return fmt.Errorf("%w: %s needs the %s role", ErrPermissionDenied, fullMethod, RootRole)
+	}
+	if len(as) == 0 || p.user.hasRole(RootRole) {
+		return nil
+	}
+	d, err := s.loadAuth(ctx)
+	if err != nil {
+		return err
+	}
+	for _, a := range as {
+		if d.allowed(p.user, a) {
+			continue
+		}
+		verb := "read"
+		if a.write {
+			verb = "write"
+		}
+		return fmt.Errorf("%w: %s may not %s %q", ErrPermissionDenied, p.name, verb, a.start)
+	}
+	return nil
+}
+
+// authorizeLease checks that the principal holds a lease, by having granted
+// it or by being allowed to write a key attached to it. Revoking deletes every
+// attached key, so it needs write access to all of them as well.
+func (s *BalancerServer) authorizeLease(ctx context.Context, p *principal, id int64, revoke bool) error {
+	if p.user.hasRole(RootRole) {
+		return nil
+	}
+	owner, keys, ok := s.leases.holder(id)
+	if !ok {
+		// the handlers report unknown leases
+		return nil
+	}
+	held := owner != "" && owner == p.name
+	if len(keys) > 0 {
+		d, err := s.loadAuth(ctx)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if d.allowed(p.user, keyAccess(key, true)) {
+				held = true
+			} else if revoke {
+				return fmt.Errorf("%w: %s may not write %q", ErrPermissionDenied, p.name, key)
+			}
+		}
+	}
+	if !held {
+		return fmt.Errorf("%w: %s does not hold lease %d", ErrPermissionDenied, p.name, id)
+	}
+	return nil
+}
+
+// AuthUnaryInterceptor enforces the users' permissions when auth is enabled.
+// It runs after forwarding, so requests are checked where they are served.
+func (s *BalancerServer) AuthUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !s.auth.enabled {
+		return handler(ctx, req)
+	}
+	p, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, p, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, principalKey{}, p), req)
+}
+
+// AuthStreamInterceptor enforces the users' permissions on every message a
+// client streams.
+func (s *BalancerServer) AuthStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !s.auth.enabled {
+		return handler(srv, ss)
+	}
+	p, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authStream{
+		ServerStream: ss,
+		ctx:          context.WithValue(ss.Context(), principalKey{}, p),
+		s:            s,
+		p:            p,
+		method:       info.FullMethod,
+	})
+}
+
+type authStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	s      *BalancerServer
+	p      *principal
+	method string
+}
+
+func (as *authStream) Context() context.Context {
+	return as.ctx
+}
+
+func (as *authStream) RecvMsg(m interface{}) error {
+	if err := as.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return as.s.authorize(as.ctx, as.p, as.method, m)
+}
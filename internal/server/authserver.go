@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+)
+
+var _ v1.AuthServer = (*authServer)(nil)
+
+// authServer manages the users and roles checked by the auth interceptors.
+type authServer struct {
+	v1.UnimplementedAuthServer
+	s *BalancerServer
+}
+
+func (s *BalancerServer) Auth() v1.AuthServer {
+	return &authServer{s: s}
+}
+
+func (a *authServer) PutRole(ctx context.Context, request *v1.PutRoleRequest) (*v1.PutRoleResponse, error) {
+	role := request.Role
+	if role == nil || role.Name == "" {
+		return nil, fmt.Errorf("%w: role needs a name", ErrInvalidRequest)
+	}
+	if role.Name == RootRole {
+		return nil, fmt.Errorf("%w: the %s role is built in", ErrInvalidRequest, RootRole)
+	}
+	r := &authRole{}
+	for _, p := range role.Permissions {
+		r.Permissions = append(r.Permissions, permission{Prefix: p.Prefix, Read: p.Read, Write: p.Write})
+	}
+	if err := a.s.updateAuth(ctx, func(d *authData) error {
+		d.Roles[role.Name] = r
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &v1.PutRoleResponse{}, nil
+}
+
+// DeleteRole removes a role, taking it away from every user that had it.
+func (a *authServer) DeleteRole(ctx context.Context, request *v1.DeleteRoleRequest) (*v1.DeleteRoleResponse, error) {
+	if err := a.s.updateAuth(ctx, func(d *authData) error {
+		if _, ok := d.Roles[request.Name]; !ok {
+			return fmt.Errorf("%w: %s", ErrRoleNotFound, request.Name)
+		}
+		delete(d.Roles, request.Name)
+		for _, u := range d.Users {
+			roles := u.Roles[:0]
+			for _, r := range u.Roles {
+				if r != request.Name {
+					roles = append(roles, r)
+				}
+			}
+			u.Roles = roles
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &v1.DeleteRoleResponse{}, nil
+}
+
+func (a *authServer) ListRoles(ctx context.Context, request *v1.ListRolesRequest) (*v1.ListRolesResponse, error) {
+	d, err := a.s.loadAuth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp := &v1.ListRolesResponse{}
+	for name, r := range d.Roles {
+		role := &v1.Role{Name: name}
+		for _, p := range r.Permissions {
+			role.Permissions = append(role.Permissions, &v1.Permission{Prefix: p.Prefix, Read: p.Read, Write: p.Write})
+		}
+		resp.Roles = append(resp.Roles, role)
+	}
+	sort.Slice(resp.Roles, func(i, j int) bool {
+		return resp.Roles[i].Name < resp.Roles[j].Name
+	})
+	return resp, nil
+}
+
+func (a *authServer) PutUser(ctx context.Context, request *v1.PutUserRequest) (*v1.PutUserResponse, error) {
+	if request.Name == "" {
+		return nil, fmt.Errorf("%w: user needs a name", ErrInvalidRequest)
+	}
+	if err := a.s.updateAuth(ctx, func(d *authData) error {
+		for _, r := range request.Roles {
+			if _, ok := d.Roles[r]; !ok && r != RootRole {
+				return fmt.Errorf("%w: %s", ErrRoleNotFound, r)
+			}
+		}
+		u, ok := d.Users[request.Name]
+		if !ok {
+			u = &authUser{}
+			d.Users[request.Name] = u
+		}
+		u.Roles = request.Roles
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &v1.PutUserResponse{}, nil
+}
+
+func (a *authServer) DeleteUser(ctx context.Context, request *v1.DeleteUserRequest) (*v1.DeleteUserResponse, error) {
+	if err := a.s.updateAuth(ctx, func(d *authData) error {
+		if _, ok := d.Users[request.Name]; !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, request.Name)
+		}
+		delete(d.Users, request.Name)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &v1.DeleteUserResponse{}, nil
+}
+
+func (a *authServer) ListUsers(ctx context.Context, request *v1.ListUsersRequest) (*v1.ListUsersResponse, error) {
+	d, err := a.s.loadAuth(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp := &v1.ListUsersResponse{}
+	for name, u := range d.Users {
+		resp.Users = append(resp.Users, userProto(name, u))
+	}
+	sort.Slice(resp.Users, func(i, j int) bool {
+		return resp.Users[i].Name < resp.Users[j].Name
+	})
+	return resp, nil
+}
+
+// IssueToken hands out a new bearer token for a user.
+func (a *authServer) IssueToken(ctx context.Context, request *v1.IssueTokenRequest) (*v1.IssueTokenResponse, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if err := a.s.updateAuth(ctx, func(d *authData) error {
+		u, ok := d.Users[request.User]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, request.User)
+		}
+		u.Tokens = append(u.Tokens, hashToken(token))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &v1.IssueTokenResponse{Token: token}, nil
+}
+
+func (a *authServer) RevokeTokens(ctx context.Context, request *v1.RevokeTokensRequest) (*v1.RevokeTokensResponse, error) {
+	if err := a.s.updateAuth(ctx, func(d *authData) error {
+		u, ok := d.Users[request.User]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, request.User)
+		}
+		u.Tokens = nil
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return &v1.RevokeTokensResponse{}, nil
+}
+
+// WhoAmI returns the user a request is made as, which is only known with
+// auth enabled.
+func (a *authServer) WhoAmI(ctx context.Context, request *v1.WhoAmIRequest) (*v1.WhoAmIResponse, error) {
+	p, ok := ctx.Value(principalKey{}).(*principal)
+	if !ok {
+		return nil, fmt.Errorf("%w: auth is not enabled", ErrUnauthenticated)
+	}
+	return &v1.WhoAmIResponse{User: userProto(p.name, p.user)}, nil
+}
+
+func userProto(name string, u *authUser) *v1.User {
+	return &v1.User{
+		Name:   name,
+		Roles:  u.Roles,
+		Tokens: int32(len(u.Tokens)),
+	}
+}
@@ -1,126 +1,124 @@
 package server
 
 import (
-	"context"
 	"fmt"
 	"log"
-	"time"
-
-	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
+// AddClient connects to a worker and onboards it, returning once it is active
+// or onboarding failed.
 func (s *BalancerServer) AddClient(serverID, grpcAddr, raftAddr string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	client, err := s.registerClient(serverID, grpcAddr, raftAddr)
+	if err != nil {
+		return err
+	}
+	return s.onboard(client)
+}
 
+func (s *BalancerServer) registerClient(serverID, grpcAddr, raftAddr string) (*Client, error) {
 	log.Printf("adding client %s to cluster\n", serverID)
 
-	conn, err := grpc.Dial(grpcAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	wc, err := s.conns.acquire(serverID, grpcAddr)
 	if err != nil {
-		return fmt.Errorf("failed to connect to %s", grpcAddr)
+		return nil, fmt.Errorf("failed to connect to %s: %w", grpcAddr, err)
 	}
-	worker := workerApi.NewWorkerClient(conn)
 	client := &Client{
 		ServerID:     serverID,
 		GRPCAddr:     grpcAddr,
 		RaftAddr:     raftAddr,
-		WorkerClient: worker,
+		WorkerClient: wc.client(),
+		conn:         wc,
+		stats:        wc.stats,
+		health:       wc.health,
+		onboarding:   newOnboarding(s.memberEvents.notify),
+		stop:         make(chan struct{}),
 	}
 
-	s.workers[serverID] = client
-	// if there is one worker, it means this client is the first in. Make it leader.
-	if len(s.workers) == 1 {
-		// wait for leader hangs until the server responds that it is a leader
-		// there is an election process that needs to end before we
-		// can start the assignment process.
-		s.leaderID = client.ServerID
-		return waitForLeader(client)
-	} else {
-		// otherwise we want to tell them to join the leader.
-		return s.connectToLeader(client)
+	var old *Client
+	s.update(func(r *routing) {
+		old = r.workers[serverID]
+		r.workers[serverID] = client
+		// onboarding finds the shard again
+		delete(r.shardOf, serverID)
+	})
+	if old != nil {
+		close(old.stop)
 	}
+	go client.probe(client.stop)
+	return client, nil
 }
 
 func (s *BalancerServer) RemoveClient(serverID string) error {
-	delete(s.workers, serverID)
-	if s.leaderID == serverID {
-		s.leaderID = ""
+	var c *Client
+	s.update(func(r *routing) {
+		c = r.workers[serverID]
+		if shardID, ok := r.shardOf[serverID]; ok && r.leaders[shardID] == serverID {
+			delete(r.leaders, shardID)
+		}
+		delete(r.workers, serverID)
+		delete(r.shardOf, serverID)
+	})
+	if c != nil {
+		close(c.stop)
+		s.conns.release(serverID)
 	}
 	return nil
 }
 
 func (s *BalancerServer) NewLeadership(serverID, grpcAddr, raftAddr string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.leaderID = serverID
-
+	s.update(func(r *routing) {
+		if shardID, ok := r.shardOf[serverID]; ok {
+			r.setLeader(shardID, serverID)
+		}
+	})
 	return nil
 }
 
-func waitForLeader(c *Client) error {
-	log.Printf("getting raft state from %s\n", c.ServerID)
-	resp, err := c.RaftState(context.Background(), &workerApi.RaftStateRequest{})
-	if err != nil {
-		return err
-	}
-
-	log.Printf("raft state: %s\n", resp.State)
-	if resp.State != "Leader" {
-		log.Printf("waiting for %s to announce leadership.\n", c.ServerID)
-		time.Sleep(time.Second)
-		waitForLeader(c)
+// setLeader points writes for a shard at a new leader.
+func (s *BalancerServer) setLeader(shardID, serverID string) {
+	if s.routing().leaders[shardID] == serverID {
+		return
 	}
-	return nil
+	s.update(func(r *routing) {
+		r.setLeader(shardID, serverID)
+	})
 }
 
-func (s *BalancerServer) connectToLeader(c *Client) error {
-	leader, ok := s.workers[s.leaderID]
-	if !ok {
-		log.Printf("backing off waiting for leadership claim\n")
-		time.Sleep(time.Second)
-		return s.connectToLeader(c)
-	}
-
-	resp, err := leader.WorkerClient.RaftState(context.Background(), &workerApi.RaftStateRequest{})
-	// TODO it is possible that this would loop forever. Maybe should implement a finite backoff.
-	if err != nil || resp.State != "Leader" {
-		log.Printf("need a timeout since my request for leader info failed, or I am asking the wrong server.\n")
-		time.Sleep(time.Second)
-		return s.connectToLeader(c)
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	if _, err := leader.Join(ctx, &workerApi.JoinRequest{
-		ServerAddr: c.RaftAddr,
-		ServerId:   c.ServerID,
-	}); err != nil {
-		return err
-	}
-	s.workers[c.ServerID] = c
-	return nil
+// Memberlist describes the workers of every shard, Leader and Followers are
+// those of the first shard.
+type Memberlist struct {
+	Leader    string
+	Followers []string
+	Shards    []ShardMembers
 }
 
-type Memberlist struct {
+type ShardMembers struct {
+	ID        string
 	Leader    string
 	Followers []string
 }
 
 func (s *BalancerServer) GetMembers() *Memberlist {
-	if len(s.workers) == 0 {
+	r := s.routing()
+	if len(r.workers) == 0 {
 		return nil
 	}
 
 	ret := &Memberlist{}
-	ret.Leader = s.leaderID
-	for _, w := range s.workers {
-		if w.ServerID == s.leaderID {
-			continue
+	for _, id := range r.knownShards(s.routes.Load()) {
+		sh := ShardMembers{
+			ID:     id,
+			Leader: r.leaders[id],
+		}
+		for _, w := range r.shardWorkers(id) {
+			if w.ServerID == sh.Leader {
+				continue
+			}
+			sh.Followers = append(sh.Followers, w.ServerID)
 		}
-		ret.Followers = append(ret.Followers, w.ServerID)
+		ret.Shards = append(ret.Shards, sh)
 	}
+	ret.Leader = ret.Shards[0].Leader
+	ret.Followers = ret.Shards[0].Followers
 	return ret
 }
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// batchChunkSize is the number of items forwarded to the workers together.
+	batchChunkSize = 100
+	// batchConcurrency caps the in flight requests per chunk.
+	batchConcurrency = 16
+	// batchChunkTimeout bounds each chunk, replacing the per request timeout.
+	batchChunkTimeout = 5 * time.Second
+)
+
+func (s *BalancerServer) BatchInsert(ctx context.Context, request *v1.BatchInsertRequest) (*v1.BatchInsertResponse, error) {
+	return &v1.BatchInsertResponse{
+		Results: inChunks(request.Items, func(chunk []*v1.InsertRequest, offset int) []*v1.BatchResult {
+			return s.insertChunk(ctx, chunk, offset)
+		}),
+	}, nil
+}
+
+func (s *BalancerServer) BatchDelete(ctx context.Context, request *v1.BatchDeleteRequest) (*v1.BatchDeleteResponse, error) {
+	return &v1.BatchDeleteResponse{
+		Results: inChunks(request.Items, func(chunk []*v1.DeleteRequest, offset int) []*v1.BatchResult {
+			return s.deleteChunk(ctx, chunk, offset)
+		}),
+	}, nil
+}
+
+func (s *BalancerServer) BatchFetch(ctx context.Context, request *v1.BatchFetchRequest) (*v1.BatchFetchResponse, error) {
+	return &v1.BatchFetchResponse{
+		Results: inChunks(request.Items, func(chunk []*v1.FetchRequest, offset int) []*v1.BatchResult {
+			return s.fetchChunk(ctx, chunk, offset)
+		}),
+	}, nil
+}
+
+func (s *BalancerServer) BatchInsertStream(stream v1.Agent_BatchInsertStreamServer) error {
+	results, err := streamChunks(stream.Recv, func(chunk []*v1.InsertRequest, offset int) []*v1.BatchResult {
+		return s.insertChunk(stream.Context(), chunk, offset)
+	})
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&v1.BatchInsertResponse{Results: results})
+}
+
+func (s *BalancerServer) BatchDeleteStream(stream v1.Agent_BatchDeleteStreamServer) error {
+	results, err := streamChunks(stream.Recv, func(chunk []*v1.DeleteRequest, offset int) []*v1.BatchResult {
+		return s.deleteChunk(stream.Context(), chunk, offset)
+	})
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&v1.BatchDeleteResponse{Results: results})
+}
+
+func (s *BalancerServer) BatchFetchStream(stream v1.Agent_BatchFetchStreamServer) error {
+	results, err := streamChunks(stream.Recv, func(chunk []*v1.FetchRequest, offset int) []*v1.BatchResult {
+		return s.fetchChunk(stream.Context(), chunk, offset)
+	})
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(&v1.BatchFetchResponse{Results: results})
+}
+
+func (s *BalancerServer) insertChunk(ctx context.Context, chunk []*v1.InsertRequest, offset int) []*v1.BatchResult {
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	log.Printf("insert batch of %d\n", len(chunk))
+
+	ctx, cancel := context.WithTimeout(ctx, batchChunkTimeout)
+	defer cancel()
+	return s.runChunk(len(chunk), offset, func(i int) *v1.BatchResult {
+		return &v1.BatchResult{Key: chunk[i].Key}
+	}, func(i int, r *v1.BatchResult) error {
+		if err := checkValue(chunk[i].Value); err != nil {
+			return err
+		}
+		return s.withLeader(ctx, s.keyShard(chunk[i].Key), func(ctx context.Context, leader *Client) error {
+			return s.insertTo(ctx, leader, chunk[i])
+		})
+	})
+}
+
+func (s *BalancerServer) deleteChunk(ctx context.Context, chunk []*v1.DeleteRequest, offset int) []*v1.BatchResult {
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	log.Printf("delete batch of %d\n", len(chunk))
+
+	ctx, cancel := context.WithTimeout(ctx, batchChunkTimeout)
+	defer cancel()
+	return s.runChunk(len(chunk), offset, func(i int) *v1.BatchResult {
+		return &v1.BatchResult{Key: chunk[i].Key}
+	}, func(i int, r *v1.BatchResult) error {
+		return s.withLeader(ctx, s.keyShard(chunk[i].Key), func(ctx context.Context, leader *Client) error {
+			return s.deleteFrom(ctx, leader, chunk[i].Key)
+		})
+	})
+}
+
+func (s *BalancerServer) fetchChunk(ctx context.Context, chunk []*v1.FetchRequest, offset int) []*v1.BatchResult {
+	log.Printf("fetch batch of %d\n", len(chunk))
+
+	ctx, cancel := context.WithTimeout(ctx, batchChunkTimeout)
+	defer cancel()
+	return s.runChunk(len(chunk), offset, func(i int) *v1.BatchResult {
+		return &v1.BatchResult{Key: chunk[i].Key}
+	}, func(i int, r *v1.BatchResult) error {
+		if err := checkKey(chunk[i].Key); err != nil {
+			return err
+		}
+		f, err := s.readTarget(ctx, chunk[i])
+		if err != nil {
+			return err
+		}
+		resp, err := f.Fetch(ctx, &workerApi.FetchRequest{
+			Key: chunk[i].Key,
+		})
+		if err != nil {
+			return err
+		}
+		r.Value = resp.Value
+		return nil
+	})
+}
+
+// runChunk runs do for every item of a chunk with bounded concurrency and
+// collects a result per item in order. Items for the same key run one after
+// another in the order given, so the last write to a key is the one kept.
+func (s *BalancerServer) runChunk(n, offset int, result func(i int) *v1.BatchResult, do func(i int, r *v1.BatchResult) error) []*v1.BatchResult {
+	results := make([]*v1.BatchResult, n)
+	var keys []string
+	byKey := make(map[string][]int)
+	for i := 0; i < n; i++ {
+		r := result(i)
+		r.Index = int64(offset + i)
+		results[i] = r
+
+		if _, ok := byKey[r.Key]; !ok {
+			keys = append(keys, r.Key)
+		}
+		byKey[r.Key] = append(byKey[r.Key], i)
+	}
+
+	sem := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for _, k := range keys {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(items []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			for _, i := range items {
+				r := results[i]
+				if err := do(i, r); err != nil {
+					st := status.Convert(s.statusError(err))
+					r.Code = int32(st.Code())
+					r.Error = st.Message()
+					continue
+				}
+				r.Ok = true
+			}
+		}(byKey[k])
+	}
+	wg.Wait()
+	return results
+}
+
+// inChunks splits items into chunks of batchChunkSize and runs each in turn.
+func inChunks[T any](items []T, run func(chunk []T, offset int) []*v1.BatchResult) []*v1.BatchResult {
+	results := make([]*v1.BatchResult, 0, len(items))
+	for offset := 0; offset < len(items); offset += batchChunkSize {
+		end := offset + batchChunkSize
+		if end > len(items) {
+			end = len(items)
+		}
+		results = append(results, run(items[offset:end], offset)...)
+	}
+	return results
+}
+
+// streamChunks receives items until the client closes the stream, running
+// each chunk as soon as it fills up.
+func streamChunks[T any](recv func() (T, error), run func(chunk []T, offset int) []*v1.BatchResult) ([]*v1.BatchResult, error) {
+	var (
+		results []*v1.BatchResult
+		chunk   []T
+		offset  int
+	)
+	for {
+		item, err := recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chunk = append(chunk, item)
+		if len(chunk) == batchChunkSize {
+			results = append(results, run(chunk, offset)...)
+			offset += len(chunk)
+			chunk = nil
+		}
+	}
+	if len(chunk) > 0 {
+		results = append(results, run(chunk, offset)...)
+	}
+	return results, nil
+}
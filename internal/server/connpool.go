@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// connLinger keeps the connection of a worker that left open for a while,
+	// so one that flaps out of serf and back in keeps its connection.
+	connLinger = 30 * time.Second
+	// workerKeepaliveTime is as often as the workers allow pings, they run
+	// grpc's default enforcement policy which drops clients pinging more
+	// often than every five minutes.
+	workerKeepaliveTime    = 5 * time.Minute
+	workerKeepaliveTimeout = 20 * time.Second
+)
+
+// workerConn is a connection to a worker along with what the agent has
+// learnt about the worker through it, which outlives rejoins.
+type workerConn struct {
+	serverID string
+	addr     string
+	conn     *grpc.ClientConn
+	stats    *clientStats
+	health   *clientHealth
+	// linger closes the connection once the worker has been gone a while.
+	linger *time.Timer
+}
+
+// connPool owns the connections to the workers, keyed by server id.
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]*workerConn
+	creds credentials.TransportCredentials
+}
+
+// newConnPool dials workers with creds, plaintext when nil.
+func newConnPool(creds credentials.TransportCredentials) *connPool {
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	return &connPool{conns: make(map[string]*workerConn), creds: creds}
+}
+
+// acquire returns the connection to a worker, reusing the open one unless
+// the worker moved to a new address.
+func (p *connPool) acquire(serverID, addr string) (*workerConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if wc, ok := p.conns[serverID]; ok {
+		if wc.linger != nil {
+			wc.linger.Stop()
+			wc.linger = nil
+		}
+		if wc.addr == addr && wc.conn.GetState() != connectivity.Shutdown {
+			log.Printf("reusing connection to %s\n", serverID)
+			return wc, nil
+		}
+		wc.conn.Close()
+		delete(p.conns, serverID)
+	}
+
+	wc := &workerConn{
+		serverID: serverID,
+		addr:     addr,
+		stats:    &clientStats{},
+		health:   &clientHealth{},
+	}
+	conn, err := grpc.Dial(addr,
+		grpc.WithTransportCredentials(p.creds),
+		grpc.WithChainUnaryInterceptor(wc.stats.unaryInterceptor, wc.healthInterceptor),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:    workerKeepaliveTime,
+			Timeout: workerKeepaliveTimeout,
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	wc.conn = conn
+	p.conns[serverID] = wc
+	go wc.watch()
+	return wc, nil
+}
+
+// release closes a worker's connection after connLinger, unless the worker
+// is acquired again in the meantime.
+func (p *connPool) release(serverID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	wc, ok := p.conns[serverID]
+	if !ok || wc.linger != nil {
+		return
+	}
+	wc.linger = time.AfterFunc(connLinger, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.conns[serverID] != wc {
+			return
+		}
+		log.Printf("closing connection to %s\n", serverID)
+		wc.conn.Close()
+		delete(p.conns, serverID)
+	})
+}
+
+// watch logs the connection's state changes until it is closed.
+func (wc *workerConn) watch() {
+	state := wc.conn.GetState()
+	for state != connectivity.Shutdown {
+		if !wc.conn.WaitForStateChange(context.Background(), state) {
+			return
+		}
+		state = wc.conn.GetState()
+		log.Printf("connection to %s is %s\n", wc.serverID, state)
+	}
+}
+
+// healthInterceptor feeds the outcome of every call to the worker into its
+// circuit breaker. Only failures that point at the worker itself count.
+func (wc *workerConn) healthInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	switch status.Code(err) {
+	case codes.OK:
+		wc.health.success(wc.serverID)
+	case codes.Unavailable, codes.DeadlineExceeded:
+		wc.health.failure(wc.serverID, err)
+	}
+	return err
+}
+
+func (wc *workerConn) client() workerApi.WorkerClient {
+	return workerApi.NewWorkerClient(wc.conn)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+)
+
+// readTarget picks the worker that can serve a fetch at the requested consistency.
+func (s *BalancerServer) readTarget(ctx context.Context, request *v1.FetchRequest) (*Client, error) {
+	shardID := s.keyShard(request.Key)
+	switch request.Consistency {
+	case v1.FetchRequest_LINEARIZABLE:
+		return s.confirmedLeader(ctx, shardID)
+	case v1.FetchRequest_BOUNDED_STALENESS:
+		// followers catch up within a raft heartbeat or two, so once a key has
+		// been left alone for longer than the bound any follower is good enough.
+		// The workers do not report how far a follower lags, so a follower
+		// cut off from its leader can still be picked, the bound is best
+		// effort as agent.proto says.
+		maxStaleness := request.GetMaxStaleness().AsDuration()
+		if maxStaleness <= 0 || s.index.modifiedSince(request.Key, time.Now().Add(-maxStaleness)) {
+			return s.confirmedLeader(ctx, shardID)
+		}
+		return s.nextFollower(shardID)
+	default:
+		return s.nextFollower(shardID)
+	}
+}
+
+// confirmedLeader returns the leader of a shard once it has confirmed that it
+// still leads, so a read from it cannot miss an acknowledged write.
+func (s *BalancerServer) confirmedLeader(ctx context.Context, shardID string) (*Client, error) {
+	var confirmed *Client
+	err := s.withLeader(ctx, shardID, func(ctx context.Context, leader *Client) error {
+		if !isLeader(ctx, leader) {
+			return ErrNotLeader
+		}
+		confirmed = leader
+		return nil
+	})
+	return confirmed, err
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+)
+
+const (
+	// coordinatorKey holds the coordinator lease in the meta shard.
+	coordinatorKey = reservedPrefix + "coordinator"
+	// coordinatorTTL is how long the lease has to go unrenewed, as seen on
+	// another agent's clock, before that agent may take it over.
+	coordinatorTTL = 10 * time.Second
+	// coordinatorRenew is how often the holder renews the lease and the
+	// other agents read it.
+	coordinatorRenew = 2 * time.Second
+	// coordinatorSettle is how long a claim waits before it is read back.
+	// An agent that found the lease free at the same time has written its
+	// own claim by then, so only one of them reads back its own.
+	coordinatorSettle = 2 * time.Second
+	// coordinatorCallTimeout bounds each read and write of the lease. It
+	// has to stay below coordinatorSettle.
+	coordinatorCallTimeout = time.Second
+	// coordinatorDrift is taken off the holder's lease so it stops before
+	// anyone else may start, even with clocks running at different rates.
+	coordinatorDrift = 2 * time.Second
+)
+
+// ErrNoCoordinator is returned while no agent is known to hold the
+// coordinator lease, for example while it is being taken over.
+var ErrNoCoordinator = errors.New("no agent is coordinating")
+
+// coordinatorLease is the record stored under coordinatorKey. The holder
+// bumps Renewal on every renewal, so the record only stays the same when
+// the holder has stopped renewing it.
+type coordinatorLease struct {
+	Owner   string `json:"owner"`
+	Term    int64  `json:"term"`
+	Renewal int64  `json:"renewal"`
+}
+
+// election keeps track of the coordinator lease. Workers have no compare
+// and set, so an agent claims a free lease by writing it, waiting
+// coordinatorSettle and reading it back. The holder renews it well within
+// coordinatorTTL and counts its lease from before each renewal was sent,
+// the others count from when they saw the record change, so the holder's
+// lease always runs out first. Writes to the meta shard are fenced by the
+// lease, see fence.
+type election struct {
+	mu sync.Mutex
+	// seen is the last record read and seenAt when it was first read.
+	seen   coordinatorLease
+	seenAt time.Time
+	// held is set while we hold the lease for term, until validUntil.
+	held       bool
+	term       int64
+	validUntil time.Time
+	// writes is held shared by fenced writes, so resigning can wait for
+	// those in flight.
+	writes sync.RWMutex
+}
+
+// holding returns when our lease runs out, ok is false when we do not
+// hold it.
+func (e *election) holding() (until time.Time, ok bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.held || !time.Now().Before(e.validUntil) {
+		return time.Time{}, false
+	}
+	return e.validUntil, true
+}
+
+// owner returns the agent holding the lease as last read, or "" when it
+// has gone unrenewed for too long to trust.
+func (e *election) owner() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.seenAt.IsZero() || time.Since(e.seenAt) >= coordinatorTTL {
+		return ""
+	}
+	return e.seen.Owner
+}
+
+// observe records the lease as read at now and reports whether it has
+// gone unrenewed for coordinatorTTL or was given up.
+func (e *election) observe(l coordinatorLease, now time.Time) (free bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if l != e.seen || e.seenAt.IsZero() {
+		e.seen, e.seenAt = l, now
+	}
+	return l.Owner == "" || now.Sub(e.seenAt) >= coordinatorTTL
+}
+
+// RunElection keeps trying to hold the coordinator lease until ctx is done.
+// The lease is stored in the meta shard, so nothing happens until it has a
+// worker.
+func (s *BalancerServer) RunElection(ctx context.Context) {
+	t := time.NewTicker(coordinatorRenew)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if !s.metaReady() {
+			continue
+		}
+		if err := s.campaign(ctx); err != nil {
+			log.Printf("coordinator election failed: %v\n", err)
+		}
+	}
+}
+
+// campaign renews the lease if we hold it, or claims it once it is free.
+func (s *BalancerServer) campaign(ctx context.Context) error {
+	e := s.election
+	cur, err := s.readCoordinatorLease(ctx)
+	if err != nil {
+		// a holder keeps its lease until validUntil and stops after
+		return err
+	}
+	now := time.Now()
+	free := e.observe(cur, now)
+
+	e.mu.Lock()
+	mine := e.held && cur.Owner == s.peers.self && cur.Term == e.term && now.Before(e.validUntil)
+	lost := e.held && !mine
+	if lost {
+		e.held = false
+	}
+	e.mu.Unlock()
+	if lost {
+		log.Printf("lost the coordinator lease\n")
+		s.resignState()
+	}
+
+	if mine {
+		next := cur
+		next.Renewal++
+		start := time.Now()
+		if err := s.writeCoordinatorLease(ctx, next); err != nil {
+			return err
+		}
+		e.mu.Lock()
+		if e.held && e.term == next.Term {
+			e.validUntil = start.Add(coordinatorTTL - coordinatorDrift)
+		}
+		e.mu.Unlock()
+		return nil
+	}
+	if !free {
+		return nil
+	}
+
+	claim := coordinatorLease{Owner: s.peers.self, Term: cur.Term + 1}
+	start := time.Now()
+	if err := s.writeCoordinatorLease(ctx, claim); err != nil {
+		return err
+	}
+	if err := sleepCtx(ctx, coordinatorSettle); err != nil {
+		return err
+	}
+	got, err := s.readCoordinatorLease(ctx)
+	if err != nil {
+		return err
+	}
+	e.observe(got, time.Now())
+	if got != claim {
+		return nil
+	}
+	e.mu.Lock()
+	e.held, e.term = true, claim.Term
+	e.validUntil = start.Add(coordinatorTTL - coordinatorDrift)
+	e.mu.Unlock()
+	log.Printf("holding the coordinator lease for term %d\n", claim.Term)
+	return nil
+}
+
+// ResignCoordinator gives up the coordinator lease, if we hold it, so
+// another agent can take over without waiting for it to lapse. Fenced writes
+// still in flight are waited for first.
+func (s *BalancerServer) ResignCoordinator(ctx context.Context) error {
+	e := s.election
+	e.mu.Lock()
+	held, term := e.held && time.Now().Before(e.validUntil), e.term
+	e.held = false
+	e.mu.Unlock()
+	if !held {
+		return nil
+	}
+	s.resignState()
+
+	e.writes.Lock()
+	e.writes.Unlock()
+	return s.writeCoordinatorLease(ctx, coordinatorLease{Term: term})
+}
+
+// fence lets a write to the meta shard through while we hold the
+// coordinator lease. The write's context ends when the lease runs out, and
+// done has to be called once it returns.
+func (s *BalancerServer) fence(ctx context.Context) (context.Context, func(), error) {
+	e := s.election
+	e.writes.RLock()
+	until, ok := e.holding()
+	if !ok {
+		e.writes.RUnlock()
+		return nil, nil, fmt.Errorf("%w: not the coordinator", ErrIndexUnavailable)
+	}
+	ctx, cancel := context.WithDeadline(ctx, until)
+	return ctx, func() {
+		cancel()
+		e.writes.RUnlock()
+	}, nil
+}
+
+func (s *BalancerServer) readCoordinatorLease(ctx context.Context) (coordinatorLease, error) {
+	ctx, cancel := context.WithTimeout(ctx, coordinatorCallTimeout)
+	defer cancel()
+	var l coordinatorLease
+	val, ok, err := s.fetchMeta(ctx, coordinatorKey)
+	if err != nil || !ok {
+		return l, err
+	}
+	if err := json.Unmarshal([]byte(val), &l); err != nil {
+		return l, fmt.Errorf("bad coordinator lease: %w", err)
+	}
+	return l, nil
+}
+
+// writeCoordinatorLease is the one write to the meta shard that is not
+// fenced, the lease is what the fence checks.
+func (s *BalancerServer) writeCoordinatorLease(ctx context.Context, l coordinatorLease) error {
+	ctx, cancel := context.WithTimeout(ctx, coordinatorCallTimeout)
+	defer cancel()
+	return s.putMeta(ctx, coordinatorKey, l)
+}
+
+// metaReady reports whether the meta shard has a worker to store state in.
+func (s *BalancerServer) metaReady() bool {
+	return len(s.routing().shardWorkers(metaShard)) > 0
+}
+
+// putMeta writes a value to the meta shard, callers other than the election
+// go through saveMeta.
+func (s *BalancerServer) putMeta(ctx context.Context, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.withLeader(ctx, metaShard, func(ctx context.Context, leader *Client) error {
+		_, err := leader.Insert(ctx, &workerApi.InsertRequest{Key: key, Value: string(b)})
+		return err
+	})
+}
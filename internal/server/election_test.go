@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestElectionObserve(t *testing.T) {
+	now := time.Now()
+	held := coordinatorLease{Owner: "agent-a", Term: 3, Renewal: 7}
+	tests := []struct {
+		name  string
+		seen  coordinatorLease
+		since time.Duration
+		read  coordinatorLease
+		free  bool
+		owner string
+	}{
+		{"first read", coordinatorLease{}, 0, held, false, "agent-a"},
+		{"no lease stored", coordinatorLease{}, 0, coordinatorLease{}, true, ""},
+		{"given up", held, time.Second, coordinatorLease{Term: 3}, true, ""},
+		{"renewed", held, coordinatorTTL, coordinatorLease{Owner: "agent-a", Term: 3, Renewal: 8}, false, "agent-a"},
+		{"unchanged within ttl", held, coordinatorTTL / 2, held, false, "agent-a"},
+		{"unchanged for ttl", held, coordinatorTTL, held, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &election{seen: tt.seen}
+			// a zero since means the lease has not been read before
+			if tt.since > 0 {
+				e.seenAt = now.Add(-tt.since)
+			}
+			if free := e.observe(tt.read, now); free != tt.free {
+				t.Errorf("observe() free = %v, want %v", free, tt.free)
+			}
+			if owner := e.owner(); owner != tt.owner {
+				t.Errorf("owner() = %q, want %q", owner, tt.owner)
+			}
+		})
+	}
+}
+
+func TestElectionHolding(t *testing.T) {
+	e := &election{held: true, term: 1, validUntil: time.Now().Add(time.Minute)}
+	if _, ok := e.holding(); !ok {
+		t.Fatal("holding() = false for a lease still valid")
+	}
+	e.validUntil = time.Now().Add(-time.Millisecond)
+	if _, ok := e.holding(); ok {
+		t.Fatal("holding() = true for a lease that ran out")
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// errorDomain is the ErrorInfo domain of errors raised by the agent.
+	errorDomain = "dinghy.agent"
+	// unavailableRetryDelay is the retry hint sent while there is no leader.
+	unavailableRetryDelay = time.Second
+)
+
+// UnaryErrorInterceptor converts the errors returned by handlers into grpc statuses.
+func (s *BalancerServer) UnaryErrorInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	return resp, s.statusError(err)
+}
+
+// StreamErrorInterceptor converts the errors returned by stream handlers into grpc statuses.
+func (s *BalancerServer) StreamErrorInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return s.statusError(handler(srv, ss))
+}
+
+// statusError maps balancer and worker errors to a grpc status, so clients
+// can tell a missing leader from a missing key from a timeout. Statuses the
+// workers already set are passed through untouched.
+func (s *BalancerServer) statusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		return err
+	}
+
+	shardID := ""
+	var se *shardError
+	if errors.As(err, &se) {
+		shardID = se.shardID
+	}
+
+	switch {
+	case errors.Is(err, ErrNoServers):
+		return s.unavailable(err, "NO_SERVERS", shardID)
+	case errors.Is(err, ErrNotLeader), isLeadershipError(err):
+		return s.unavailable(err, "NOT_LEADER", shardID)
+	case errors.Is(err, ErrIndexUnavailable):
+		return s.unavailable(err, "INDEX_UNAVAILABLE", metaShard)
+	case errors.Is(err, ErrNoCoordinator):
+		return s.unavailable(err, "NO_COORDINATOR", metaShard)
+	case errors.Is(err, ErrLeaseNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrLeaseExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrMoveInFlight), errors.Is(err, ErrMemberState), errors.Is(err, ErrKeyring), errors.Is(err, ErrUnknownRevision), errors.Is(err, ErrIndexIncomplete):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, ErrPermissionDenied):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, ErrMemberNotFound), errors.Is(err, ErrUserNotFound), errors.Is(err, ErrRoleNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrUnsupported):
+		return status.Error(codes.Unimplemented, err.Error())
+	case errors.Is(err, ErrLeaseTTL), errors.Is(err, ErrInvalidRequest):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return err
+}
+
+// shardError ties an error to the shard it happened on.
+type shardError struct {
+	shardID string
+	err     error
+}
+
+func (e *shardError) Error() string {
+	return fmt.Sprintf("%s: %v", e.shardID, e.err)
+}
+
+func (e *shardError) Unwrap() error {
+	return e.err
+}
+
+// unavailable builds an Unavailable status carrying a retry hint and the
+// shard's leader as the agent currently sees it.
+func (s *BalancerServer) unavailable(err error, reason, shardID string) error {
+	st, detailErr := status.New(codes.Unavailable, err.Error()).WithDetails(
+		&errdetails.RetryInfo{
+			RetryDelay: durationpb.New(unavailableRetryDelay),
+		},
+		&errdetails.ErrorInfo{
+			Reason: reason,
+			Domain: errorDomain,
+			Metadata: map[string]string{
+				"shard_id":  shardID,
+				"leader_id": s.routing().leaders[shardID],
+			},
+		},
+	)
+	if detailErr != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return st.Err()
+}
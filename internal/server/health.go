@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+)
+
+const (
+	healthProbeInterval = 2 * time.Second
+	healthProbeTimeout  = time.Second
+	// outlierThreshold is the number of consecutive failures, probes or
+	// regular calls alike, that eject a worker from read rotation.
+	outlierThreshold = 3
+	minEjection      = 5 * time.Second
+	maxEjection      = 5 * time.Minute
+)
+
+// clientHealth is a circuit breaker for a worker. Failed calls and probes trip
+// it, after which the worker sits out of read rotation for an ejection period
+// that doubles with every trip. Once the period is over the next successful
+// probe lets it back in.
+type clientHealth struct {
+	mu           sync.Mutex
+	failures     int
+	ejected      bool
+	ejectedUntil time.Time
+	ejections    int
+	lastEjection time.Time
+}
+
+func (h *clientHealth) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.ejected
+}
+
+func (h *clientHealth) success(serverID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures = 0
+	if !h.ejected {
+		// forget old ejections once the worker has behaved for a while
+		if h.ejections > 0 && time.Since(h.lastEjection) > maxEjection {
+			h.ejections = 0
+		}
+		return
+	}
+	if time.Now().Before(h.ejectedUntil) {
+		return
+	}
+	h.ejected = false
+	log.Printf("%s is healthy again, returning it to read rotation\n", serverID)
+}
+
+func (h *clientHealth) failure(serverID string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures++
+	if h.ejected || h.failures < outlierThreshold {
+		return
+	}
+
+	ejection := minEjection << h.ejections
+	if ejection > maxEjection || ejection <= 0 {
+		ejection = maxEjection
+	}
+	h.ejected = true
+	h.ejections++
+	h.lastEjection = time.Now()
+	h.ejectedUntil = h.lastEjection.Add(ejection)
+	log.Printf("ejecting %s from read rotation for %s: %v\n", serverID, ejection, err)
+}
+
+// probe pings the worker until stop is closed.
+func (c *Client) probe(stop <-chan struct{}) {
+	t := time.NewTicker(healthProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), healthProbeTimeout)
+			// the interceptor records the outcome
+			_, _ = c.RaftState(ctx, &workerApi.RaftStateRequest{})
+			cancel()
+		}
+	}
+}
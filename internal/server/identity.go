@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/izaakdale/dinghy-agent/internal/certs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// forwardedForHeader carries the identity of the client behind a
+	// forwarded request, since the coordinator only sees the forwarding
+	// agent's certificate.
+	forwardedForHeader = "dinghy-forwarded-for"
+	// forwardedAnonymous is forwarded for clients without a certificate.
+	forwardedAnonymous = "anonymous"
+)
+
+type callerKey struct{}
+
+// Caller returns the identity of the client certificate a request was made
+// with, false when it came without one.
+func Caller(ctx context.Context) (certs.Peer, bool) {
+	p, ok := ctx.Value(callerKey{}).(certs.Peer)
+	return p, ok
+}
+
+// caller works out who is behind a request. The identity forwarded by
+// another agent is only trusted from a caller shown to be an agent. A
+// forwarded request never takes the identity of its certificate, which is
+// the forwarding agent's, so it is anonymous unless an identity came with it.
+func (s *BalancerServer) caller(ctx context.Context) (certs.Peer, bool) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if len(md.Get(forwardedHeader)) == 0 && len(md.Get(forwardedForHeader)) == 0 {
+		return certs.PeerFromContext(ctx)
+	}
+	v := md.Get(forwardedForHeader)
+	if len(v) == 0 || v[0] == forwardedAnonymous || !s.fromAgent(ctx) {
+		return certs.Peer{}, false
+	}
+	var p certs.Peer
+	if err := json.Unmarshal([]byte(v[0]), &p); err != nil {
+		return certs.Peer{}, false
+	}
+	return p, true
+}
+
+// fromAgent reports whether the request came from another agent, which is
+// when its verified client certificate shows the identity agents expect of
+// each other. Without tls, or without a peer identity set, no request does.
+func (s *BalancerServer) fromAgent(ctx context.Context) bool {
+	leaf, ok := certs.LeafFromContext(ctx)
+	return ok && s.peerIdentity.Matches(leaf)
+}
+
+func (s *BalancerServer) withCaller(ctx context.Context) context.Context {
+	if p, ok := s.caller(ctx); ok {
+		return context.WithValue(ctx, callerKey{}, p)
+	}
+	return ctx
+}
+
+// IdentityUnaryInterceptor makes the caller's identity available to handlers
+// through Caller.
+func (s *BalancerServer) IdentityUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(s.withCaller(ctx), req)
+}
+
+// IdentityStreamInterceptor makes the caller's identity available to
+// streaming handlers through Caller.
+func (s *BalancerServer) IdentityStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &callerStream{ServerStream: ss, ctx: s.withCaller(ss.Context())})
+}
+
+type callerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (cs *callerStream) Context() context.Context {
+	return cs.ctx
+}
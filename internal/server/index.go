@@ -0,0 +1,240 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// keyIndex keeps an ordered view of the keys written through the agent.
+// Workers only serve point lookups, so range scans walk this index and then
+// fetch the values from the workers. Every write bumps the index revision,
+// which is also used to track per key versions. The coordinator stores the
+// index in the meta shard, see state.go.
+type keyIndex struct {
+	mu         sync.RWMutex
+	tree       *btree.BTreeG[*keyMeta]
+	rev        int64
+	lastDelete time.Time
+}
+
+// keyMeta is what the agent knows about a key, the value itself lives on the
+// workers. A version of 0 marks a key that was touched ahead of its first
+// write, which may or may not have reached the worker.
+type keyMeta struct {
+	key            string
+	createRevision int64
+	modRevision    int64
+	version        int64
+	lease          int64
+	modTime        time.Time
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		tree: btree.NewG(32, func(a, b *keyMeta) bool {
+			return a.key < b.key
+		}),
+	}
+}
+
+// put records a write to key and returns the new revision along with the
+// lease the key was previously attached to.
+func (i *keyIndex) put(key string, lease int64) (int64, int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rev++
+
+	m, ok := i.tree.Get(&keyMeta{key: key})
+	if !ok {
+		m = &keyMeta{key: key}
+		i.tree.ReplaceOrInsert(m)
+	}
+	if m.version == 0 {
+		m.createRevision = i.rev
+	}
+	prevLease := m.lease
+	m.modRevision = i.rev
+	m.version++
+	m.lease = lease
+	m.modTime = time.Now()
+	return i.rev, prevLease
+}
+
+// delete records the removal of key and returns the new revision along with
+// the lease the key was attached to.
+func (i *keyIndex) delete(key string) (int64, int64) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.rev++
+	i.lastDelete = time.Now()
+
+	m, ok := i.tree.Delete(&keyMeta{key: key})
+	if !ok {
+		return i.rev, 0
+	}
+	return i.rev, m.lease
+}
+
+// touch adds key ahead of its first write without bumping the revision, so
+// listings and moves find it whether or not the write is recorded. It reports
+// whether the key was new.
+func (i *keyIndex) touch(key string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.tree.Get(&keyMeta{key: key}); ok {
+		return false
+	}
+	i.tree.ReplaceOrInsert(&keyMeta{key: key, modTime: time.Now()})
+	return true
+}
+
+// has reports whether key is in the index, touched keys included.
+func (i *keyIndex) has(key string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	_, ok := i.tree.Get(&keyMeta{key: key})
+	return ok
+}
+
+// get returns a copy of the metadata held for key. Touched keys have no
+// metadata yet and are reported as missing.
+func (i *keyIndex) get(key string) (keyMeta, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	m, ok := i.tree.Get(&keyMeta{key: key})
+	if !ok || m.version == 0 {
+		return keyMeta{}, false
+	}
+	return *m, true
+}
+
+// modifiedSince reports whether key may have changed after t. Deleted keys
+// are not tracked individually, so any delete after t counts for unknown keys.
+func (i *keyIndex) modifiedSince(key string, t time.Time) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if m, ok := i.tree.Get(&keyMeta{key: key}); ok {
+		return m.modTime.After(t)
+	}
+	return i.lastDelete.After(t)
+}
+
+func (i *keyIndex) revision() int64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.rev
+}
+
+// keys returns the keys in [start, end) in order, an empty end means there is
+// no upper bound. A limit of 0 or less returns every matching key.
+func (i *keyIndex) keys(start, end string, limit int) []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var ret []string
+	i.tree.AscendGreaterOrEqual(&keyMeta{key: start}, func(m *keyMeta) bool {
+		if end != "" && m.key >= end {
+			return false
+		}
+		ret = append(ret, m.key)
+		return limit <= 0 || len(ret) < limit
+	})
+	return ret
+}
+
+// metas returns a copy of the metadata of the keys in [start, end), in order.
+func (i *keyIndex) metas(start, end string) []keyMeta {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var ret []keyMeta
+	i.tree.AscendGreaterOrEqual(&keyMeta{key: start}, func(m *keyMeta) bool {
+		if end != "" && m.key >= end {
+			return false
+		}
+		ret = append(ret, *m)
+		return true
+	})
+	return ret
+}
+
+// leaseKeys returns the keys attached to each lease.
+func (i *keyIndex) leaseKeys() map[int64][]string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	ret := make(map[int64][]string)
+	i.tree.Ascend(func(m *keyMeta) bool {
+		if m.lease != 0 {
+			ret[m.lease] = append(ret[m.lease], m.key)
+		}
+		return true
+	})
+	return ret
+}
+
+// replace swaps the contents of the index for those of other. Modification
+// times are not stored, so every key counts as modified just now.
+func (i *keyIndex) replace(other *keyIndex) {
+	other.mu.Lock()
+	now := time.Now()
+	other.tree.Ascend(func(m *keyMeta) bool {
+		m.modTime = now
+		return true
+	})
+	tree, rev := other.tree, other.rev
+	other.mu.Unlock()
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.tree, i.rev, i.lastDelete = tree, rev, now
+}
+
+// keysWhere returns the keys match accepts, in order.
+func (i *keyIndex) keysWhere(match func(key string) bool) []string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var ret []string
+	i.tree.Ascend(func(m *keyMeta) bool {
+		if match(m.key) {
+			ret = append(ret, m.key)
+		}
+		return true
+	})
+	return ret
+}
+
+// keyBounds resolves a key, range end and prefix flag to the [start, end)
+// bounds understood by the index.
+func keyBounds(key, rangeEnd string, prefix bool) (string, string) {
+	if prefix {
+		return key, prefixEnd(key)
+	}
+	if rangeEnd == "" {
+		// no range end means a single key
+		return key, key + "\x00"
+	}
+	return key, rangeEnd
+}
+
+// inBounds reports whether key falls within [start, end), an empty end means
+// there is no upper bound.
+func inBounds(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or an empty string if there is no such key.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
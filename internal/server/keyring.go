@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+)
+
+// ErrKeyring is returned when a gossip keyring operation fails.
+var ErrKeyring = errors.New("gossip keyring operation failed")
+
+// KeyringResult is how the members answered a keyring operation.
+type KeyringResult struct {
+	// Keys and PrimaryKeys map each key to the number of members holding it.
+	Keys        map[string]int
+	PrimaryKeys map[string]int
+	Members     int
+	Responses   int
+	Errors      int
+	Messages    map[string]string
+}
+
+// Keyring manages the gossip encryption keys of every member of the cluster.
+type Keyring interface {
+	ListKeys() (*KeyringResult, error)
+	InstallKey(key string) (*KeyringResult, error)
+	UseKey(key string) (*KeyringResult, error)
+	RemoveKey(key string) (*KeyringResult, error)
+}
+
+// SetKeyring hands the server the cluster's keyring once gossip is up.
+func (s *BalancerServer) SetKeyring(k Keyring) {
+	s.keyring.Store(&k)
+}
+
+func (a *adminServer) ListGossipKeys(ctx context.Context, request *v1.ListGossipKeysRequest) (*v1.GossipKeyringResponse, error) {
+	return a.keyringOp(ctx, func(k Keyring) (*KeyringResult, error) {
+		return k.ListKeys()
+	})
+}
+
+func (a *adminServer) InstallGossipKey(ctx context.Context, request *v1.GossipKeyRequest) (*v1.GossipKeyringResponse, error) {
+	return a.keyringOp(ctx, func(k Keyring) (*KeyringResult, error) {
+		return k.InstallKey(request.Key)
+	})
+}
+
+func (a *adminServer) UseGossipKey(ctx context.Context, request *v1.GossipKeyRequest) (*v1.GossipKeyringResponse, error) {
+	return a.keyringOp(ctx, func(k Keyring) (*KeyringResult, error) {
+		key, err := resolveGossipKey(k, request.Key)
+		if err != nil {
+			return nil, err
+		}
+		return k.UseKey(key)
+	})
+}
+
+func (a *adminServer) RemoveGossipKey(ctx context.Context, request *v1.GossipKeyRequest) (*v1.GossipKeyringResponse, error) {
+	return a.keyringOp(ctx, func(k Keyring) (*KeyringResult, error) {
+		key, err := resolveGossipKey(k, request.Key)
+		if err != nil {
+			return nil, err
+		}
+		return k.RemoveKey(key)
+	})
+}
+
+// gossipKeyFingerprint names a key without giving away the key itself.
+func gossipKeyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// resolveGossipKey returns the installed key a fingerprint names, anything
+// else is taken to be the key itself.
+func resolveGossipKey(k Keyring, key string) (string, error) {
+	res, err := k.ListKeys()
+	if err != nil {
+		return "", err
+	}
+	for installed := range res.Keys {
+		if gossipKeyFingerprint(installed) == key {
+			return installed, nil
+		}
+	}
+	return key, nil
+}
+
+// keyringOp runs an operation against the keyring. The keys decrypt all of
+// gossip, so only root may use the keyring and never without auth. Members
+// that failed are reported as an error, naming what each of them said.
+func (a *adminServer) keyringOp(ctx context.Context, op func(k Keyring) (*KeyringResult, error)) (*v1.GossipKeyringResponse, error) {
+	p, ok := ctx.Value(principalKey{}).(*principal)
+	if !ok {
+		return nil, fmt.Errorf("%w: the gossip keyring needs auth enabled", ErrPermissionDenied)
+	}
+	if !p.user.hasRole(RootRole) {
+		return nil, fmt.Errorf("%w: the gossip keyring needs the %s role", ErrPermissionDenied, RootRole)
+	}
+	k := a.s.keyring.Load()
+	if k == nil {
+		return nil, fmt.Errorf("%w: gossip is not up yet", ErrKeyring)
+	}
+	res, err := op(*k)
+	if err != nil {
+		if res != nil && len(res.Messages) > 0 {
+			return nil, fmt.Errorf("%w: %v %v", ErrKeyring, err, res.Messages)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrKeyring, err)
+	}
+
+	resp := &v1.GossipKeyringResponse{
+		Keys:        make(map[string]int32, len(res.Keys)),
+		PrimaryKeys: make(map[string]int32, len(res.PrimaryKeys)),
+		Members:     int32(res.Members),
+		Responses:   int32(res.Responses),
+		Errors:      int32(res.Errors),
+		Messages:    res.Messages,
+	}
+	for key, n := range res.Keys {
+		resp.Keys[gossipKeyFingerprint(key)] = int32(n)
+	}
+	for key, n := range res.PrimaryKeys {
+		resp.PrimaryKeys[gossipKeyFingerprint(key)] = int32(n)
+	}
+	return resp, nil
+}
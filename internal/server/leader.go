@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// leaderCallTimeout bounds each attempt at a leader call.
+	leaderCallTimeout = time.Second
+	// leaderRetryTimeout bounds the retries when the caller set no deadline.
+	leaderRetryTimeout = 10 * time.Second
+	minLeaderBackoff   = 50 * time.Millisecond
+	maxLeaderBackoff   = time.Second
+)
+
+var ErrNotLeader = errors.New("leader could not confirm its leadership")
+
+// withLeader runs call against the leader of a shard. When there is no leader,
+// it cannot be reached or it no longer leads, the shard's workers are asked who
+// leads now and call is retried until ctx is done. Only idempotent calls should
+// be retried.
+func (s *BalancerServer) withLeader(ctx context.Context, shardID string, call func(ctx context.Context, leader *Client) error) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, leaderRetryTimeout)
+		defer cancel()
+	}
+
+	backoff := minLeaderBackoff
+	for {
+		leader, err := s.leader(ctx, shardID)
+		if err != nil {
+			return err
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, leaderCallTimeout)
+		err = call(attemptCtx, leader)
+		cancel()
+		if err == nil || !leaderRetryable(ctx, err) {
+			return err
+		}
+
+		log.Printf("leader %s failed the request, looking for a new leader: %v\n", leader.ServerID, err)
+		s.forgetLeader(shardID, leader.ServerID)
+		if err := sleepCtx(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = nextBackoff(backoff, maxLeaderBackoff)
+	}
+}
+
+// leader returns the known leader of a shard, or asks the shard's workers who
+// leads until one answers or ctx is done.
+func (s *BalancerServer) leader(ctx context.Context, shardID string) (*Client, error) {
+	backoff := minLeaderBackoff
+	for {
+		if leader, ok := s.routing().shardLeader(shardID); ok {
+			return leader, nil
+		}
+		if leader := s.discoverLeader(ctx, shardID); leader != nil {
+			return leader, nil
+		}
+		if len(s.routing().shardWorkers(shardID)) == 0 {
+			return nil, &shardError{shardID: shardID, err: ErrNoServers}
+		}
+		if err := sleepCtx(ctx, backoff); err != nil {
+			return nil, &shardError{shardID: shardID, err: ErrNoServers}
+		}
+		backoff = nextBackoff(backoff, maxLeaderBackoff)
+	}
+}
+
+// discoverLeader asks every worker of a shard for its raft state and adopts
+// the first one that claims to lead.
+func (s *BalancerServer) discoverLeader(ctx context.Context, shardID string) *Client {
+	for _, c := range s.routing().activeWorkers(shardID) {
+		if isLeader(ctx, c) {
+			log.Printf("discovered %s as leader of %s\n", c.ServerID, shardID)
+			s.setLeader(shardID, c.ServerID)
+			return c
+		}
+	}
+	return nil
+}
+
+func (s *BalancerServer) forgetLeader(shardID, serverID string) {
+	if shardID == "" || s.routing().leaders[shardID] != serverID {
+		return
+	}
+	s.update(func(r *routing) {
+		// someone may have found the new leader in the meantime
+		if r.leaders[shardID] == serverID {
+			r.setLeader(shardID, "")
+		}
+	})
+}
+
+// confirmClaim makes c the leader of its shard once the worker itself says it
+// leads, so a heartbeat alone cannot move writes.
+func (s *BalancerServer) confirmClaim(c *Client, shardID string) {
+	if !isLeader(context.Background(), c) {
+		log.Printf("ignoring leadership claim from %s, it is not leading\n", c.ServerID)
+		return
+	}
+	if r := s.routing(); r.workers[c.ServerID] != c || r.shardOf[c.ServerID] != shardID {
+		return
+	}
+	log.Printf("new leadership claim from %s for %s\n", c.ServerID, shardID)
+	s.setLeader(shardID, c.ServerID)
+}
+
+func isLeader(ctx context.Context, c *Client) bool {
+	ctx, cancel := context.WithTimeout(ctx, leaderCallTimeout)
+	defer cancel()
+	resp, err := c.RaftState(ctx, &workerApi.RaftStateRequest{})
+	return err == nil && resp.State == "Leader"
+}
+
+// leaderRetryable reports whether err means the request should go to another
+// leader, as opposed to the request itself being at fault.
+func leaderRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if errors.Is(err, ErrNotLeader) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Canceled:
+		return true
+	}
+	return isLeadershipError(err)
+}
+
+// isLeadershipError reports whether a worker turned a request down because
+// it does not lead, workers report raft leadership errors as plain strings.
+func isLeadershipError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "not the leader") ||
+		strings.Contains(msg, "leadership lost") ||
+		strings.Contains(msg, "must make this request to leader")
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func nextBackoff(d, max time.Duration) time.Duration {
+	d *= 2
+	if d > max {
+		return max
+	}
+	return d
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+)
+
+// leaseExpireTimeout bounds the deletes made when a lease lapses.
+const leaseExpireTimeout = 5 * time.Second
+
+var (
+	ErrLeaseTTL    = errors.New("lease ttl must be greater than zero")
+	ErrLeaseExists = errors.New("lease already exists")
+)
+
+// lessor tracks leases and the keys attached to them. Workers have no notion
+// of leases, so they live in the coordinator and lapsed leases are turned
+// into deletes sent to whichever worker leads at the time. Grants and revokes
+// are stored with the key index, see state.go.
+type lessor struct {
+	mu     sync.Mutex
+	leases map[int64]*lease
+	expire func(id int64, keys []string)
+}
+
+type lease struct {
+	id  int64
+	ttl time.Duration
+	// owner is the user that granted the lease, empty without auth.
+	owner  string
+	expiry time.Time
+	timer  *time.Timer
+	keys   map[string]struct{}
+}
+
+func newLessor(expire func(id int64, keys []string)) *lessor {
+	return &lessor{
+		leases: make(map[int64]*lease),
+		expire: expire,
+	}
+}
+
+// grant creates a lease owned by owner, picking an id if none is given.
+func (l *lessor) grant(id int64, ttl time.Duration, owner string) (int64, error) {
+	if ttl <= 0 {
+		return 0, ErrLeaseTTL
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if id == 0 {
+		for id == 0 || l.leases[id] != nil {
+			id = rand.Int63()
+		}
+	} else if _, ok := l.leases[id]; ok {
+		return 0, ErrLeaseExists
+	}
+
+	l.start(id, ttl, owner)
+	return id, nil
+}
+
+// start adds a lease with its expiry a ttl from now. Callers hold mu.
+func (l *lessor) start(id int64, ttl time.Duration, owner string) *lease {
+	ls := &lease{
+		id:     id,
+		ttl:    ttl,
+		owner:  owner,
+		expiry: time.Now().Add(ttl),
+		keys:   make(map[string]struct{}),
+	}
+	ls.timer = time.AfterFunc(ttl, func() {
+		l.lapse(id)
+	})
+	l.leases[id] = ls
+	return ls
+}
+
+// restore replaces every lease with those granted, attaching keys to them.
+// The time left on a lease is not stored, so each one starts its ttl afresh.
+func (l *lessor) restore(granted map[int64]stateLease, keys map[int64][]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stopAll()
+	for id, g := range granted {
+		ls := l.start(id, g.TTL, g.Owner)
+		for _, k := range keys[id] {
+			ls.keys[k] = struct{}{}
+		}
+	}
+}
+
+// reset drops every lease without expiring it, for when another agent has
+// taken them over.
+func (l *lessor) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopAll()
+}
+
+// stopAll removes every lease. Callers hold mu.
+func (l *lessor) stopAll() {
+	for id, ls := range l.leases {
+		ls.timer.Stop()
+		delete(l.leases, id)
+	}
+}
+
+// grants returns every lease as it was granted.
+func (l *lessor) grants() map[int64]stateLease {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ret := make(map[int64]stateLease, len(l.leases))
+	for id, ls := range l.leases {
+		ret[id] = stateLease{TTL: ls.ttl, Owner: ls.owner}
+	}
+	return ret
+}
+
+// holder returns the owner of a lease and the keys attached to it.
+func (l *lessor) holder(id int64) (string, []string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ls, ok := l.leases[id]
+	if !ok {
+		return "", nil, false
+	}
+	return ls.owner, ls.keyList(), true
+}
+
+// renew pushes a lease expiry back by its ttl.
+func (l *lessor) renew(id int64) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ls, ok := l.leases[id]
+	if !ok {
+		return 0, false
+	}
+	ls.expiry = time.Now().Add(ls.ttl)
+	ls.timer.Reset(ls.ttl)
+	return ls.ttl, true
+}
+
+// revoke removes the lease and returns the keys that were attached to it.
+func (l *lessor) revoke(id int64) ([]string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ls, ok := l.leases[id]
+	if !ok {
+		return nil, false
+	}
+	ls.timer.Stop()
+	delete(l.leases, id)
+	return ls.keyList(), true
+}
+
+func (l *lessor) lapse(id int64) {
+	keys, ok := l.revoke(id)
+	if !ok {
+		return
+	}
+	log.Printf("lease %d expired with %d keys attached\n", id, len(keys))
+	l.expire(id, keys)
+}
+
+func (l *lessor) exists(id int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.leases[id]
+	return ok
+}
+
+// attach adds key to a lease, reporting false if the lease is gone.
+func (l *lessor) attach(id int64, key string) bool {
+	if id == 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ls, ok := l.leases[id]
+	if !ok {
+		return false
+	}
+	ls.keys[key] = struct{}{}
+	return true
+}
+
+func (l *lessor) detach(id int64, key string) {
+	if id == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ls, ok := l.leases[id]; ok {
+		delete(ls.keys, key)
+	}
+}
+
+// timeToLive returns the remaining and granted ttl of a lease and its keys.
+func (l *lessor) timeToLive(id int64) (time.Duration, time.Duration, []string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ls, ok := l.leases[id]
+	if !ok {
+		return 0, 0, nil, false
+	}
+	return time.Until(ls.expiry), ls.ttl, ls.keyList(), true
+}
+
+func (ls *lease) keyList() []string {
+	keys := make([]string, 0, len(ls.keys))
+	for k := range ls.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// expireLease deletes the keys of a revoked or lapsed lease. Keys that have
+// since been rewritten under another lease are left alone.
+func (s *BalancerServer) expireLease(id int64, keys []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseExpireTimeout)
+	defer cancel()
+
+	for _, k := range keys {
+		if !s.leasedTo(k, id) {
+			continue
+		}
+		if err := s.remove(ctx, k); err != nil {
+			log.Printf("failed to delete %s for lease %d: %v\n", k, id, err)
+		}
+	}
+}
+
+// leasedTo reports whether key is still attached to the lease id. It waits on
+// commitMu so a write that attached the key before the lease went has landed
+// in the index.
+func (s *BalancerServer) leasedTo(key string, id int64) bool {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+	m, ok := s.index.get(key)
+	return ok && m.lease == id
+}
+
+// dropUnleased deletes a key written under a lease that lapsed before the
+// write was recorded, it would have gone with the lease had it been attached
+// in time.
+func (s *BalancerServer) dropUnleased(ctx context.Context, leader *Client, key string) {
+	if err := s.deleteFrom(ctx, leader, key); err != nil {
+		log.Printf("failed to delete %s written under a lapsed lease: %v\n", key, err)
+	}
+}
+
+// leaseLapsed stores that a lease lapsed and deletes its keys. A lapse that
+// fails to be stored is harmless, the lease comes back with the index and
+// lapses again.
+func (s *BalancerServer) leaseLapsed(id int64, keys []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), leaseExpireTimeout)
+	defer cancel()
+
+	s.commitMu.Lock()
+	err := s.appendState(ctx, stateEntry{Op: stateOpRevoke, Lease: id})
+	s.commitMu.Unlock()
+	if err != nil {
+		log.Printf("failed to store the lapse of lease %d: %v\n", id, err)
+	}
+	s.expireLease(id, keys)
+}
+
+// revokeLease stores the revoke of a lease, then drops it and returns the
+// keys that were attached to it.
+func (s *BalancerServer) revokeLease(ctx context.Context, id int64) ([]string, error) {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	if !s.leases.exists(id) {
+		return nil, ErrLeaseNotFound
+	}
+	if err := s.appendState(ctx, stateEntry{Op: stateOpRevoke, Lease: id}); err != nil {
+		return nil, err
+	}
+	keys, ok := s.leases.revoke(id)
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+	return keys, nil
+}
+
+func (s *BalancerServer) LeaseGrant(ctx context.Context, request *v1.LeaseGrantRequest) (*v1.LeaseGrantResponse, error) {
+	ttl := time.Duration(request.Ttl) * time.Second
+
+	var owner string
+	if p, ok := ctx.Value(principalKey{}).(*principal); ok {
+		owner = p.name
+	}
+
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+	id, err := s.leases.grant(request.Id, ttl, owner)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.appendState(ctx, stateEntry{Op: stateOpGrant, Lease: id, TTL: ttl, Owner: owner}); err != nil {
+		s.leases.revoke(id)
+		return nil, err
+	}
+	return &v1.LeaseGrantResponse{
+		Id:  id,
+		Ttl: request.Ttl,
+	}, nil
+}
+
+func (s *BalancerServer) LeaseRevoke(ctx context.Context, request *v1.LeaseRevokeRequest) (*v1.LeaseRevokeResponse, error) {
+	keys, err := s.revokeLease(ctx, request.Id)
+	if err != nil {
+		return nil, err
+	}
+	s.expireLease(request.Id, keys)
+	return &v1.LeaseRevokeResponse{}, nil
+}
+
+func (s *BalancerServer) LeaseKeepAlive(stream v1.Agent_LeaseKeepAliveServer) error {
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// an unknown lease is reported with a ttl of 0 rather than ending the stream
+		ttl, _ := s.leases.renew(request.Id)
+		if err := stream.Send(&v1.LeaseKeepAliveResponse{
+			Id:  request.Id,
+			Ttl: int64(ttl / time.Second),
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *BalancerServer) LeaseTimeToLive(ctx context.Context, request *v1.LeaseTimeToLiveRequest) (*v1.LeaseTimeToLiveResponse, error) {
+	remaining, granted, keys, ok := s.leases.timeToLive(request.Id)
+	if !ok {
+		return &v1.LeaseTimeToLiveResponse{
+			Id:  request.Id,
+			Ttl: -1,
+		}, nil
+	}
+
+	resp := &v1.LeaseTimeToLiveResponse{
+		Id:         request.Id,
+		Ttl:        int64(math.Ceil(remaining.Seconds())),
+		GrantedTtl: int64(granted / time.Second),
+	}
+	if request.Keys {
+		resp.Keys = keys
+	}
+	return resp, nil
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// memberPollInterval is how often a memberlist watch looks for changes that
+// raise no event, such as raft state or health.
+const memberPollInterval = 5 * time.Second
+
+// serfMember is a worker as serf last described it.
+type serfMember struct {
+	grpcAddr string
+	raftAddr string
+	status   string
+}
+
+// memberNotifier wakes memberlist watches when membership changes.
+type memberNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func newMemberNotifier() *memberNotifier {
+	return &memberNotifier{ch: make(chan struct{})}
+}
+
+func (n *memberNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+// changed returns a channel closed on the next change.
+func (n *memberNotifier) changed() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+// SetSerfStatus records a worker's gossip status. Workers that left or failed
+// are kept until serf reaps them, so they still show in the memberlist.
+func (s *BalancerServer) SetSerfStatus(serverID, grpcAddr, raftAddr, status string) {
+	s.serfMu.Lock()
+	if status == "reaped" {
+		delete(s.serfMembers, serverID)
+	} else {
+		s.serfMembers[serverID] = serfMember{grpcAddr: grpcAddr, raftAddr: raftAddr, status: status}
+	}
+	s.serfMu.Unlock()
+	s.memberEvents.notify()
+}
+
+func (s *BalancerServer) MemberlistV2(ctx context.Context, request *v1.MemberlistV2Request) (*v1.MemberlistV2Response, error) {
+	return s.memberlistV2(ctx), nil
+}
+
+func (s *BalancerServer) WatchMemberlist(request *v1.MemberlistV2Request, stream v1.Agent_WatchMemberlistServer) error {
+	ctx := stream.Context()
+	t := time.NewTicker(memberPollInterval)
+	defer t.Stop()
+
+	var last *v1.MemberlistV2Response
+	for {
+		changed := s.memberEvents.changed()
+		resp := s.memberlistV2(ctx)
+		if last == nil || !sameMembers(last, resp) {
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+			last = resp
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		case <-t.C:
+		}
+	}
+}
+
+func (s *BalancerServer) memberlistV2(ctx context.Context) *v1.MemberlistV2Response {
+	r := s.routing()
+	workers := make([]*Client, 0, len(r.workers))
+	for _, c := range r.workers {
+		workers = append(workers, c)
+	}
+	var gone []*v1.Member
+	s.serfMu.Lock()
+	for id, m := range s.serfMembers {
+		if _, ok := r.workers[id]; ok {
+			continue
+		}
+		gone = append(gone, &v1.Member{
+			Id:         id,
+			GrpcAddr:   m.grpcAddr,
+			RaftAddr:   m.raftAddr,
+			SerfStatus: m.status,
+		})
+	}
+	s.serfMu.Unlock()
+	resp := &v1.MemberlistV2Response{}
+	if members := s.GetMembers(); members != nil {
+		for _, sh := range members.Shards {
+			resp.Shards = append(resp.Shards, &v1.ShardMembers{
+				Id:        sh.ID,
+				Leader:    sh.Leader,
+				Followers: sh.Followers,
+			})
+		}
+	}
+
+	members := make([]*v1.Member, len(workers))
+	var wg sync.WaitGroup
+	for i, c := range workers {
+		wg.Add(1)
+		go func(i int, c *Client) {
+			defer wg.Done()
+			members[i] = s.member(ctx, r, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	resp.Members = append(members, gone...)
+	sort.Slice(resp.Members, func(i, j int) bool {
+		return resp.Members[i].Id < resp.Members[j].Id
+	})
+	return resp
+}
+
+// sameMembers compares memberlists ignoring heartbeat times, which change
+// every few seconds without anything happening.
+func sameMembers(a, b *v1.MemberlistV2Response) bool {
+	strip := func(r *v1.MemberlistV2Response) *v1.MemberlistV2Response {
+		r = proto.Clone(r).(*v1.MemberlistV2Response)
+		for _, m := range r.Members {
+			m.LastHeartbeat = nil
+		}
+		return r
+	}
+	return proto.Equal(strip(a), strip(b))
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+)
+
+const (
+	// onboardTimeout bounds the onboarding of a worker from discovery to active.
+	onboardTimeout     = 2 * time.Minute
+	onboardCallTimeout = 5 * time.Second
+	minOnboardBackoff  = 100 * time.Millisecond
+	maxOnboardBackoff  = 5 * time.Second
+)
+
+// onboardState is a step of bringing a worker into its raft group.
+type onboardState string
+
+const (
+	// stateDiscovered workers are known but unplaced, the coordinator places them.
+	stateDiscovered onboardState = "discovered"
+	// stateConnecting workers are being asked which shard they belong to.
+	stateConnecting onboardState = "connecting"
+	// stateWaitingForLeader workers wait for their shard to have a leader,
+	// themselves when they are the first of a shard.
+	stateWaitingForLeader onboardState = "waiting-for-leader"
+	// stateJoining workers are being added to the raft group by its leader.
+	stateJoining onboardState = "joining"
+	// stateActive workers serve requests for their shard.
+	stateActive onboardState = "active"
+	// stateFailed workers ran out of time, the next heartbeat tries again.
+	stateFailed onboardState = "failed"
+)
+
+// onboarding tracks where a worker is in its onboarding.
+type onboarding struct {
+	mu       sync.Mutex
+	state    onboardState
+	attempts int
+	err      error
+	notify   func()
+}
+
+func newOnboarding(notify func()) *onboarding {
+	return &onboarding{state: stateDiscovered, notify: notify}
+}
+
+func (o *onboarding) set(state onboardState, err error) {
+	o.mu.Lock()
+	o.state, o.attempts, o.err = state, 0, err
+	o.mu.Unlock()
+	o.notify()
+}
+
+func (o *onboarding) snapshot() (onboardState, int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.state, o.attempts, o.err
+}
+
+func (o *onboarding) is(states ...onboardState) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, st := range states {
+		if o.state == st {
+			return true
+		}
+	}
+	return false
+}
+
+// retry calls fn with backoff until it succeeds or ctx is done, keeping count
+// of the failed attempts.
+func (o *onboarding) retry(ctx context.Context, fn func(ctx context.Context) error) error {
+	backoff := minOnboardBackoff
+	for {
+		attemptCtx, cancel := context.WithTimeout(ctx, onboardCallTimeout)
+		err := fn(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		o.mu.Lock()
+		o.attempts++
+		o.err = err
+		o.mu.Unlock()
+		if err := sleepCtx(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = nextBackoff(backoff, maxOnboardBackoff)
+	}
+}
+
+// onboard brings a worker into its raft group. It gives up once
+// onboardTimeout passes or the worker is removed.
+func (s *BalancerServer) onboard(c *Client) error {
+	ctx, cancel := context.WithTimeout(context.Background(), onboardTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	placed, err := s.runOnboarding(ctx, c)
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("failed to onboard %s: %v\n", c.ServerID, err)
+	if placed {
+		// leave the worker unplaced so the next attempt starts afresh
+		s.update(func(r *routing) {
+			if shardID := r.shardOf[c.ServerID]; r.leaders[shardID] == c.ServerID {
+				r.setLeader(shardID, "")
+			}
+			delete(r.shardOf, c.ServerID)
+		})
+	}
+	c.onboarding.set(stateFailed, err)
+	return err
+}
+
+// runOnboarding walks a worker through the onboarding states, reporting
+// whether it placed the worker in a shard.
+func (s *BalancerServer) runOnboarding(ctx context.Context, c *Client) (bool, error) {
+	// workers that were placed before, by us or another agent, already know
+	// their shard and are members of its raft group.
+	c.onboarding.set(stateConnecting, nil)
+	var shardID string
+	if err := c.onboarding.retry(ctx, func(ctx context.Context) (err error) {
+		shardID, err = fetchShardID(ctx, c)
+		return err
+	}); err != nil {
+		return false, err
+	}
+
+	if shardID != "" {
+		s.update(func(r *routing) {
+			r.shardOf[c.ServerID] = shardID
+		})
+		log.Printf("%s belongs to %s\n", c.ServerID, shardID)
+		c.onboarding.set(stateActive, nil)
+		return false, nil
+	}
+	// only the coordinating agent drives workers into the raft cluster, the
+	// rest learn the shard once it has been placed.
+	if !s.IsCoordinator() {
+		c.onboarding.set(stateDiscovered, nil)
+		return false, nil
+	}
+	// placing in a single update keeps two new workers from both forming a shard
+	var first bool
+	s.update(func(r *routing) {
+		shardID = r.emptiestShard(s.routes.Load(), s.shardSize)
+		first = len(r.shardWorkers(shardID)) == 0
+		r.shardOf[c.ServerID] = shardID
+		if first {
+			r.setLeader(shardID, c.ServerID)
+		}
+	})
+	log.Printf("assigning %s to %s\n", c.ServerID, shardID)
+
+	c.onboarding.set(stateWaitingForLeader, nil)
+	if first {
+		// the worker has to win the election of its own raft group before
+		// it can take writes.
+		if err := c.onboarding.retry(ctx, func(ctx context.Context) error {
+			if !isLeader(ctx, c) {
+				return ErrNotLeader
+			}
+			_, err := c.Insert(ctx, &workerApi.InsertRequest{
+				Key:   shardIdentityKey,
+				Value: shardID,
+			})
+			return err
+		}); err != nil {
+			return true, err
+		}
+		c.onboarding.set(stateActive, nil)
+		return true, nil
+	}
+
+	leader, err := s.leader(ctx, shardID)
+	if err != nil {
+		return true, err
+	}
+	c.onboarding.set(stateJoining, nil)
+	if err := c.onboarding.retry(ctx, func(ctx context.Context) error {
+		// the shard may have changed leader since the last attempt
+		if !isLeader(ctx, leader) {
+			s.forgetLeader(shardID, leader.ServerID)
+			var err error
+			if leader, err = s.leader(ctx, shardID); err != nil {
+				return err
+			}
+		}
+		_, err := leader.Join(ctx, &workerApi.JoinRequest{
+			ServerAddr: c.RaftAddr,
+			ServerId:   c.ServerID,
+		})
+		return err
+	}); err != nil {
+		return true, err
+	}
+	c.onboarding.set(stateActive, nil)
+	return true, nil
+}
+
+// fetchShardID asks a worker which shard its raft group serves, an empty id
+// means the worker has not been placed yet.
+func fetchShardID(ctx context.Context, c *Client) (string, error) {
+	shardID, _, err := fetchValue(ctx, c, shardIdentityKey)
+	return shardID, err
+}
+
+// resolveShard onboards a worker again after it was left unplaced, either
+// because another agent was placing it or because onboarding failed.
+func (s *BalancerServer) resolveShard(c *Client) {
+	if _, busy := s.adopting.LoadOrStore(c.ServerID, true); busy {
+		return
+	}
+	defer s.adopting.Delete(c.ServerID)
+
+	if s.routing().workers[c.ServerID] == c {
+		s.onboard(c)
+	}
+}
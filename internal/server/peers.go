@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// forwardedHeader marks a request one agent has forwarded to another, so it is
+// served where it lands. It is only honoured from other agents, see fromAgent.
+const forwardedHeader = "dinghy-forwarded-by"
+
+// peerSettle is how long the agents seen through serf have to stay the same
+// before the one with the lowest name places workers, while there is no
+// meta shard to hold the coordinator lease in.
+const peerSettle = 5 * time.Second
+
+// peers tracks the other agents in the cluster. Every agent follows workers
+// and leadership through serf, but the key index, leases and watches are
+// served by a single agent, the coordinator, which holds the coordinator
+// lease in the meta shard, see election.go. The coordinator is also the only
+// agent that joins new workers to the leader. Every other agent forwards the
+// Agent api to it. The index and leases are stored in the meta shard, so
+// whichever agent coordinates next picks them up, see state.go.
+//
+// Until the meta shard has a worker there is nowhere to keep the lease, and
+// the agent with the lowest name places the first workers, once the agents
+// seen through serf have stayed the same for peerSettle.
+type peers struct {
+	mu    sync.Mutex
+	self  string
+	peers map[string]*peer
+	creds credentials.TransportCredentials
+	// changed is when an agent last joined or left.
+	changed time.Time
+}
+
+type peer struct {
+	name     string
+	grpcAddr string
+	conn     *grpc.ClientConn
+}
+
+// newPeers dials the other agents with creds, plaintext when nil.
+func newPeers(self string, creds credentials.TransportCredentials) *peers {
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+	return &peers{
+		self:    self,
+		peers:   make(map[string]*peer),
+		creds:   creds,
+		changed: time.Now(),
+	}
+}
+
+// coordinator returns the peer coordinating the cluster, or nil when it is us.
+func (p *peers) coordinator() *peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var lowest *peer
+	for _, pr := range p.peers {
+		if pr.name < p.self && (lowest == nil || pr.name < lowest.name) {
+			lowest = pr
+		}
+	}
+	return lowest
+}
+
+// get returns the known agent called name, or nil.
+func (p *peers) get(name string) *peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.peers[name]
+}
+
+// settled reports whether no agent has joined or left for peerSettle.
+func (p *peers) settled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Since(p.changed) >= peerSettle
+}
+
+func (s *BalancerServer) AddPeer(name, grpcAddr string) error {
+	log.Printf("agent %s joined @ %s\n", name, grpcAddr)
+
+	conn, err := grpc.Dial(grpcAddr, grpc.WithTransportCredentials(s.peers.creds))
+	if err != nil {
+		return fmt.Errorf("failed to connect to agent %s", grpcAddr)
+	}
+
+	s.peers.mu.Lock()
+	if old, ok := s.peers.peers[name]; ok {
+		old.conn.Close()
+	}
+	s.peers.peers[name] = &peer{
+		name:     name,
+		grpcAddr: grpcAddr,
+		conn:     conn,
+	}
+	s.peers.changed = time.Now()
+	s.peers.mu.Unlock()
+
+	if !s.IsCoordinator() {
+		s.resignState()
+	}
+	return nil
+}
+
+func (s *BalancerServer) RemovePeer(name string) error {
+	log.Printf("agent %s left\n", name)
+
+	s.peers.mu.Lock()
+	defer s.peers.mu.Unlock()
+	if pr, ok := s.peers.peers[name]; ok {
+		delete(s.peers.peers, name)
+		s.peers.changed = time.Now()
+		return pr.conn.Close()
+	}
+	return nil
+}
+
+// IsCoordinator reports whether this agent coordinates the cluster.
+func (s *BalancerServer) IsCoordinator() bool {
+	if s.metaReady() {
+		_, ok := s.election.holding()
+		return ok
+	}
+	return s.peers.coordinator() == nil && s.peers.settled()
+}
+
+// coordinatorPeer returns the coordinator, or nil when it is us.
+func (s *BalancerServer) coordinatorPeer() (*peer, error) {
+	if !s.metaReady() {
+		return s.peers.coordinator(), nil
+	}
+	if _, ok := s.election.holding(); ok {
+		return nil, nil
+	}
+	if pr := s.peers.get(s.election.owner()); pr != nil {
+		return pr, nil
+	}
+	return nil, ErrNoCoordinator
+}
+
+// forwardTarget returns the coordinator a request should be forwarded to, or
+// nil if it should be served here.
+func (s *BalancerServer) forwardTarget(ctx context.Context, fullMethod string) (*peer, error) {
+	if !forwardable(fullMethod) {
+		return nil, nil
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get(forwardedHeader)) > 0 && s.fromAgent(ctx) {
+		return nil, nil
+	}
+	return s.coordinatorPeer()
+}
+
+// forwardable reports whether a method touches state owned by the coordinator.
+// The original Memberlist is served locally from the membership view shared
+// through serf, MemberlistV2 and WatchMemberlist are forwarded along with the
+// rest of the Agent api.
+func forwardable(fullMethod string) bool {
+	return (strings.HasPrefix(fullMethod, "/agent.v1.Agent/") ||
+		strings.HasPrefix(fullMethod, "/agent.v2.Agent/") ||
+		strings.HasPrefix(fullMethod, "/agent.v1.Admin/") ||
+		strings.HasPrefix(fullMethod, "/agent.v1.Auth/")) &&
+		!strings.HasSuffix(fullMethod, "/Memberlist")
+}
+
+// needsState reports whether a method uses the key index, which has to be
+// loaded from the meta shard before the coordinator can serve it.
+func needsState(fullMethod string) bool {
+	return (strings.HasPrefix(fullMethod, "/agent.v1.Agent/") ||
+		strings.HasPrefix(fullMethod, "/agent.v2.Agent/")) &&
+		!strings.HasSuffix(fullMethod, "/Memberlist") &&
+		!strings.HasSuffix(fullMethod, "/MemberlistV2") &&
+		!strings.HasSuffix(fullMethod, "/WatchMemberlist")
+}
+
+func (s *BalancerServer) forwardContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	md = md.Copy()
+	md.Set(forwardedHeader, s.peers.self)
+	md.Set(forwardedForHeader, forwardedAnonymous)
+	if p, ok := Caller(ctx); ok {
+		if b, err := json.Marshal(p); err == nil {
+			md.Set(forwardedForHeader, string(b))
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// ForwardUnaryInterceptor forwards unary calls to the coordinator.
+func (s *BalancerServer) ForwardUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	target, err := s.forwardTarget(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil {
+		if needsState(info.FullMethod) {
+			if err := s.ensureState(ctx); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+
+	_, out, err := methodTypes(info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	reply := out.New().Interface()
+	if err := target.conn.Invoke(s.forwardContext(ctx), info.FullMethod, req, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// ForwardStreamInterceptor forwards streaming calls to the coordinator,
+// pumping messages both ways until either side is done.
+func (s *BalancerServer) ForwardStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	target, err := s.forwardTarget(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		if needsState(info.FullMethod) {
+			if err := s.ensureState(ss.Context()); err != nil {
+				return err
+			}
+		}
+		return handler(srv, ss)
+	}
+
+	in, out, err := methodTypes(info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(s.forwardContext(ss.Context()))
+	defer cancel()
+	cs, err := target.conn.NewStream(ctx, &grpc.StreamDesc{
+		ServerStreams: info.IsServerStream,
+		ClientStreams: info.IsClientStream,
+	}, info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			msg := in.New().Interface()
+			if err := ss.RecvMsg(msg); err != nil {
+				if err == io.EOF {
+					cs.CloseSend()
+				} else {
+					cancel()
+				}
+				return
+			}
+			if err := cs.SendMsg(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		msg := out.New().Interface()
+		if err := cs.RecvMsg(msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := ss.SendMsg(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// methodTypes looks up the request and response types of a grpc method.
+func methodTypes(fullMethod string) (protoreflect.MessageType, protoreflect.MessageType, error) {
+	name := strings.Replace(strings.TrimPrefix(fullMethod, "/"), "/", ".", 1)
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	md, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not a method", name)
+	}
+	in, err := protoregistry.GlobalTypes.FindMessageByName(md.Input().FullName())
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := protoregistry.GlobalTypes.FindMessageByName(md.Output().FullName())
+	if err != nil {
+		return nil, nil, err
+	}
+	return in, out, nil
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	PickerRoundRobin       = "round_robin"
+	PickerLeastOutstanding = "least_outstanding"
+	PickerPeakEWMA         = "peak_ewma"
+	PickerTwoChoices       = "p2c"
+
+	// ewmaDecay is the time constant over which old latency samples fade.
+	ewmaDecay = 10 * time.Second
+)
+
+// Picker chooses which of the candidate workers serves a read. Candidates are
+// never empty and are sorted by ServerID.
+type Picker interface {
+	Pick(candidates []*Client) *Client
+}
+
+// NewPicker returns the picker registered under name.
+func NewPicker(name string) (Picker, error) {
+	switch name {
+	case PickerRoundRobin, "":
+		return &roundRobinPicker{}, nil
+	case PickerLeastOutstanding:
+		return leastOutstandingPicker{}, nil
+	case PickerPeakEWMA:
+		return peakEWMAPicker{}, nil
+	case PickerTwoChoices:
+		return twoChoicesPicker{}, nil
+	}
+	return nil, fmt.Errorf("unknown read balancer %q", name)
+}
+
+type roundRobinPicker struct {
+	next atomic.Uint64
+}
+
+func (p *roundRobinPicker) Pick(candidates []*Client) *Client {
+	return candidates[(p.next.Add(1)-1)%uint64(len(candidates))]
+}
+
+type leastOutstandingPicker struct{}
+
+func (leastOutstandingPicker) Pick(candidates []*Client) *Client {
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.stats.outstanding.Load() < best.stats.outstanding.Load() {
+			best = c
+		}
+	}
+	return best
+}
+
+// peakEWMAPicker picks the worker with the lowest latency estimate weighted
+// by its outstanding requests. The estimate jumps straight up to slow samples
+// and only decays back down over time, so a worker that stalls is avoided
+// quickly.
+type peakEWMAPicker struct{}
+
+func (peakEWMAPicker) Pick(candidates []*Client) *Client {
+	best, bestCost := candidates[0], candidates[0].stats.cost()
+	for _, c := range candidates[1:] {
+		if cost := c.stats.cost(); cost < bestCost {
+			best, bestCost = c, cost
+		}
+	}
+	return best
+}
+
+// twoChoicesPicker samples two workers at random and takes the less loaded.
+type twoChoicesPicker struct{}
+
+func (twoChoicesPicker) Pick(candidates []*Client) *Client {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i := rand.Intn(len(candidates))
+	j := rand.Intn(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	if b.stats.outstanding.Load() < a.stats.outstanding.Load() {
+		return b
+	}
+	return a
+}
+
+// clientStats tracks the load on a worker connection for the pickers.
+type clientStats struct {
+	outstanding atomic.Int64
+
+	mu     sync.Mutex
+	ewma   float64 // nanoseconds
+	lastAt time.Time
+}
+
+func (cs *clientStats) observe(latency time.Duration) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	now := time.Now()
+	sample := float64(latency)
+	if sample > cs.ewma {
+		cs.ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(cs.lastAt)) / float64(ewmaDecay))
+		cs.ewma = cs.ewma*w + sample*(1-w)
+	}
+	cs.lastAt = now
+}
+
+func (cs *clientStats) cost() float64 {
+	cs.mu.Lock()
+	ewma := cs.ewma
+	cs.mu.Unlock()
+	return ewma * float64(cs.outstanding.Load()+1)
+}
+
+// unaryInterceptor records every call made to the worker.
+func (cs *clientStats) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	cs.outstanding.Add(1)
+	defer cs.outstanding.Add(-1)
+
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	cs.observe(time.Since(start))
+	return err
+}
+
+// nextFollower picks a healthy follower of a shard to serve a read. The
+// leader is only used when it is the shard's only serving worker. If every
+// follower has been ejected they are all tried anyway, since a possibly
+// failing read beats no read. Draining workers are never picked.
+func (s *BalancerServer) nextFollower(shardID string) (*Client, error) {
+	r := s.routing()
+	var workers []*Client
+	for _, c := range r.activeWorkers(shardID) {
+		if !c.draining.Load() {
+			workers = append(workers, c)
+		}
+	}
+	if len(workers) == 0 {
+		return nil, &shardError{shardID: shardID, err: ErrNoServers}
+	}
+
+	var followers, healthy []*Client
+	for _, c := range workers {
+		if c.ServerID != r.leaders[shardID] || len(workers) == 1 {
+			followers = append(followers, c)
+			if c.health.healthy() {
+				healthy = append(healthy, c)
+			}
+		}
+	}
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = followers
+	}
+	if len(candidates) == 0 {
+		return nil, &shardError{shardID: shardID, err: ErrNoServers}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ServerID < candidates[j].ServerID
+	})
+	return s.picker.Pick(candidates), nil
+}
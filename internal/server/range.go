@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rangeChunkSize is the number of keys sent in each streamed RangeResponse.
+const rangeChunkSize = 100
+
+func (s *BalancerServer) Range(request *v1.RangeRequest, stream v1.Agent_RangeServer) error {
+	return s.scan(stream.Context(), request, func(kvs []*v1.KeyValue, nextPageToken string) error {
+		return stream.Send(&v1.RangeResponse{
+			Kvs:           kvs,
+			NextPageToken: nextPageToken,
+			Partial:       !s.store.isComplete(),
+		})
+	})
+}
+
+// scan resolves a range request against the key index and hands the key values
+// to send in chunks. The page token is only passed along with the final chunk.
+// An empty range is sent as a single empty chunk if the index is partial, so
+// the client still learns of it.
+func (s *BalancerServer) scan(ctx context.Context, request *v1.RangeRequest, send func(kvs []*v1.KeyValue, nextPageToken string) error) error {
+	start, end := keyBounds(request.Key, request.RangeEnd, request.Prefix)
+
+	if request.PageToken != "" {
+		last, err := base64.RawURLEncoding.DecodeString(request.PageToken)
+		if err != nil {
+			return fmt.Errorf("%w: invalid page token: %v", ErrInvalidRequest, err)
+		}
+		if next := string(last) + "\x00"; next > start {
+			start = next
+		}
+	}
+
+	// ask for one more key than the limit so we know whether to hand out a page token
+	limit := int(request.Limit)
+	if limit > 0 {
+		limit++
+	}
+	keys := s.index.keys(start, end, limit)
+
+	var nextPageToken string
+	if request.Limit > 0 && len(keys) > int(request.Limit) {
+		keys = keys[:request.Limit]
+		nextPageToken = base64.RawURLEncoding.EncodeToString([]byte(keys[len(keys)-1]))
+	}
+
+	if len(keys) == 0 && !s.store.isComplete() {
+		return send(nil, "")
+	}
+	for len(keys) > 0 {
+		n := rangeChunkSize
+		if len(keys) < n {
+			n = len(keys)
+		}
+		chunk := keys[:n]
+		keys = keys[n:]
+
+		kvs, err := s.rangeChunk(ctx, chunk, request.KeysOnly)
+		if err != nil {
+			return err
+		}
+
+		var token string
+		if len(keys) == 0 {
+			token = nextPageToken
+		}
+		if err := send(kvs, token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BalancerServer) rangeChunk(ctx context.Context, keys []string, keysOnly bool) ([]*v1.KeyValue, error) {
+	kvs := make([]*v1.KeyValue, 0, len(keys))
+	if !keysOnly {
+		log.Printf("range of %d keys\n", len(keys))
+	}
+
+	// keys are spread over the shards, so a follower is picked per shard
+	followers := make(map[string]*Client)
+	for _, k := range keys {
+		// a key only touched ahead of its first write is looked up even for
+		// a keys only range, the write may never have landed
+		if _, written := s.index.get(k); keysOnly && written {
+			kvs = append(kvs, &v1.KeyValue{Key: k})
+			continue
+		}
+		shardID := s.keyShard(k)
+		f, ok := followers[shardID]
+		if !ok {
+			var err error
+			if f, err = s.nextFollower(shardID); err != nil {
+				return nil, err
+			}
+			followers[shardID] = f
+		}
+		resp, err := f.Fetch(ctx, &workerApi.FetchRequest{
+			Key: k,
+		})
+		if err != nil {
+			// the key was deleted between reading the index and the fetch
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			return nil, err
+		}
+		kv := &v1.KeyValue{Key: resp.Key}
+		if !keysOnly {
+			kv.Value = resp.Value
+		}
+		kvs = append(kvs, kv)
+	}
+	return kvs, nil
+}
@@ -0,0 +1,549 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+)
+
+const (
+	// routesKey holds the routing table in the meta shard.
+	routesKey = reservedPrefix + "routes"
+	// moveJournalKey holds the move in flight in the meta shard, so a new or
+	// restarted coordinator can pick it up where it stopped.
+	moveJournalKey = reservedPrefix + "move"
+
+	rebalanceInterval = 10 * time.Second
+	// rebalanceMinKeys stops ranges being split between shards that are
+	// both still small.
+	rebalanceMinKeys = 1000
+	// moveKeyTimeout bounds the copy or clean up of a single key.
+	moveKeyTimeout = 5 * time.Second
+)
+
+const (
+	movePhaseCopying  = "copying"
+	movePhaseCleaning = "cleaning"
+)
+
+var (
+	ErrMoveInFlight = errors.New("a shard move is already in flight")
+	// ErrIndexIncomplete is returned for moves on a cluster whose key index
+	// may be missing keys, those keys would be left behind on the source.
+	ErrIndexIncomplete = errors.New("key index is incomplete, ranges cannot be moved")
+)
+
+// moveJournal records a move of the tokens [Start, End) from Source to
+// Target. Keys are the keys the index held in the range when the move was
+// planned, workers cannot list their keys so these are what gets copied.
+// Moves only run while the index is complete.
+type moveJournal struct {
+	ID     string   `json:"id"`
+	Source string   `json:"source"`
+	Target string   `json:"target"`
+	Start  uint32   `json:"start"`
+	End    uint64   `json:"end"`
+	Phase  string   `json:"phase"`
+	Keys   []string `json:"keys"`
+}
+
+func (j *moveJournal) covers(key string) bool {
+	t := token(key)
+	return t >= j.Start && uint64(t) < j.End
+}
+
+// rebalancer tracks the move in flight on the coordinator.
+type rebalancer struct {
+	mu   sync.Mutex
+	move *moveJournal
+	// dirty holds keys in the moving range written since the copy started.
+	dirty   map[string]struct{}
+	running bool
+	// resumed is set when the move came from the journal rather than this
+	// agent, writes made before it was picked up were not tracked.
+	resumed bool
+	copied  int64
+	lastErr error
+	// loaded is set once routes and the journal have been read from the
+	// meta shard since this agent became coordinator.
+	loaded bool
+}
+
+// touch marks a written key for the final copy pass if it is being moved.
+func (r *rebalancer) touch(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.move != nil && r.move.Phase == movePhaseCopying && r.move.covers(key) {
+		r.dirty[key] = struct{}{}
+	}
+}
+
+// RunRebalancer moves ranges to shards that have none and away from shards
+// holding far more keys than the others, until ctx is done. Only the
+// coordinator moves data, the other agents keep their routes up to date so
+// they are ready to take over.
+func (s *BalancerServer) RunRebalancer(ctx context.Context) {
+	t := time.NewTicker(rebalanceInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		// nothing is stored until the meta shard has a worker
+		if !s.metaReady() {
+			continue
+		}
+
+		if !s.IsCoordinator() {
+			s.rebalance.mu.Lock()
+			s.rebalance.loaded = false
+			s.rebalance.mu.Unlock()
+			s.resignState()
+			if err := s.loadRoutes(ctx); err != nil {
+				log.Printf("failed to refresh routes: %v\n", err)
+			}
+			continue
+		}
+		if err := s.rebalanceOnce(ctx); err != nil {
+			log.Printf("rebalance failed: %v\n", err)
+		}
+	}
+}
+
+func (s *BalancerServer) rebalanceOnce(ctx context.Context) error {
+	if err := s.ensureMeta(ctx); err != nil {
+		return err
+	}
+	s.rebalance.mu.Lock()
+	move := s.rebalance.move
+	s.rebalance.mu.Unlock()
+
+	if move == nil {
+		move = s.planMove()
+		if move == nil {
+			return nil
+		}
+		log.Printf("rebalancing tokens %d-%d from %s to %s\n", move.Start, move.End, move.Source, move.Target)
+		if err := s.startMove(ctx, move); err != nil {
+			return err
+		}
+	}
+	return s.runMove(ctx)
+}
+
+// ensureMeta loads the meta shard the first time it is needed after this
+// agent became coordinator.
+func (s *BalancerServer) ensureMeta(ctx context.Context) error {
+	s.rebalance.mu.Lock()
+	loaded := s.rebalance.loaded
+	s.rebalance.mu.Unlock()
+	if loaded {
+		return nil
+	}
+	// the index is loaded first, a move resumed while it is incomplete is dropped
+	if err := s.ensureState(ctx); err != nil {
+		return err
+	}
+	if err := s.loadMeta(ctx); err != nil {
+		return err
+	}
+	s.rebalance.mu.Lock()
+	s.rebalance.loaded = true
+	s.rebalance.mu.Unlock()
+	return nil
+}
+
+// loadMeta reads the routing table and any move in flight from the meta shard.
+func (s *BalancerServer) loadMeta(ctx context.Context) error {
+	if err := s.loadRoutes(ctx); err != nil {
+		return err
+	}
+	val, ok, err := s.fetchMeta(ctx, moveJournalKey)
+	if err != nil || !ok {
+		return err
+	}
+	j := &moveJournal{}
+	if err := json.Unmarshal([]byte(val), j); err != nil {
+		return fmt.Errorf("bad move journal: %w", err)
+	}
+	if j.Phase == movePhaseCopying && !s.store.isComplete() {
+		// the range has not switched yet, so it is left on the source
+		log.Printf("dropping move %s: %v\n", j.ID, ErrIndexIncomplete)
+		return s.deleteMeta(ctx, moveJournalKey)
+	}
+	log.Printf("resuming move %s in phase %s\n", j.ID, j.Phase)
+
+	rb := s.rebalance
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.move, rb.dirty, rb.resumed, rb.copied = j, make(map[string]struct{}), true, 0
+	return nil
+}
+
+// loadRoutes adopts the routing table stored in the meta shard, or stores
+// ours if there is none yet.
+func (s *BalancerServer) loadRoutes(ctx context.Context) error {
+	val, ok, err := s.fetchMeta(ctx, routesKey)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if !s.IsCoordinator() {
+			return nil
+		}
+		return s.saveMeta(ctx, routesKey, s.routes.Load())
+	}
+	rt := &routeTable{}
+	if err := json.Unmarshal([]byte(val), rt); err != nil {
+		return fmt.Errorf("bad routing table: %w", err)
+	}
+	s.routes.Store(rt)
+	return nil
+}
+
+func (s *BalancerServer) fetchMeta(ctx context.Context, key string) (val string, ok bool, err error) {
+	err = s.withLeader(ctx, metaShard, func(ctx context.Context, leader *Client) error {
+		val, ok, err = fetchValue(ctx, leader, key)
+		return err
+	})
+	return val, ok, err
+}
+
+// saveMeta writes to the meta shard, only while we hold the coordinator
+// lease, see fence.
+func (s *BalancerServer) saveMeta(ctx context.Context, key string, v interface{}) error {
+	ctx, done, err := s.fence(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return s.putMeta(ctx, key, v)
+}
+
+func (s *BalancerServer) deleteMeta(ctx context.Context, key string) error {
+	ctx, done, err := s.fence(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return s.withLeader(ctx, metaShard, func(ctx context.Context, leader *Client) error {
+		_, err := leader.Delete(ctx, &workerApi.DeleteRequest{Key: key})
+		return err
+	})
+}
+
+// planMove picks a move for the rebalancer, or returns nil when the shards
+// are balanced. Shards without a range come first, then the range with the
+// most keys is split towards the shard with the fewest.
+func (s *BalancerServer) planMove() *moveJournal {
+	if !s.store.isComplete() {
+		return nil
+	}
+	r, rt := s.routing(), s.routes.Load()
+	rangeKeys := s.rangeKeys(rt)
+	shardKeys := make(map[string]int)
+	for i, tr := range rt.ranges {
+		shardKeys[tr.shard] += len(rangeKeys[i])
+	}
+
+	target, owned := "", false
+	for _, id := range r.knownShards(rt) {
+		if len(r.shardWorkers(id)) == 0 {
+			continue
+		}
+		_, hasRange := shardKeys[id]
+		if !hasRange {
+			target, owned = id, false
+			break
+		}
+		if target == "" || shardKeys[id] < shardKeys[target] {
+			target, owned = id, true
+		}
+	}
+	if target == "" {
+		return nil
+	}
+
+	source := -1
+	for i, tr := range rt.ranges {
+		if tr.shard != target && (source == -1 || len(rangeKeys[i]) > len(rangeKeys[source])) {
+			source = i
+		}
+	}
+	if source == -1 {
+		return nil
+	}
+	keys := rangeKeys[source]
+	if owned && (len(keys) < rebalanceMinKeys || shardKeys[rt.ranges[source].shard] <= 2*shardKeys[target]) {
+		return nil
+	}
+
+	at, ok := medianToken(keys, rt.ranges[source].start)
+	if !ok {
+		return nil
+	}
+	return s.newMove(rt, source, at, target)
+}
+
+// rangeKeys groups the keys the agent knows of by the range owning them.
+func (s *BalancerServer) rangeKeys(rt *routeTable) [][]string {
+	ret := make([][]string, len(rt.ranges))
+	for _, k := range s.index.keysWhere(func(string) bool { return true }) {
+		i := rt.rangeOf(token(k))
+		ret[i] = append(ret[i], k)
+	}
+	return ret
+}
+
+// medianToken returns the token splitting keys in half, as long as it leaves
+// something behind in the range starting at start.
+func medianToken(keys []string, start uint32) (uint32, bool) {
+	if len(keys) < 2 {
+		return 0, false
+	}
+	tokens := make([]uint32, len(keys))
+	for i, k := range keys {
+		tokens[i] = token(k)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+	at := tokens[len(tokens)/2]
+	return at, at > start
+}
+
+func (s *BalancerServer) newMove(rt *routeTable, i int, at uint32, target string) *moveJournal {
+	j := &moveJournal{
+		ID:     fmt.Sprintf("move-%d", time.Now().UnixNano()),
+		Source: rt.ranges[i].shard,
+		Target: target,
+		Start:  at,
+		End:    rt.end(i),
+		Phase:  movePhaseCopying,
+	}
+	j.Keys = s.index.keysWhere(j.covers)
+	return j
+}
+
+// startMove journals a move and makes it the one in flight.
+func (s *BalancerServer) startMove(ctx context.Context, j *moveJournal) error {
+	if !s.store.isComplete() {
+		return ErrIndexIncomplete
+	}
+	rb := s.rebalance
+	rb.mu.Lock()
+	if rb.move != nil {
+		rb.mu.Unlock()
+		return ErrMoveInFlight
+	}
+	rb.move, rb.dirty, rb.resumed, rb.copied, rb.lastErr = j, make(map[string]struct{}), false, 0, nil
+	rb.mu.Unlock()
+
+	if err := s.saveMeta(ctx, moveJournalKey, j); err != nil {
+		rb.mu.Lock()
+		rb.move = nil
+		rb.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// runMove drives the move in flight to completion. It copies the keys to the
+// target while writes carry on against the source, then holds writes off for
+// a final pass over the keys written meanwhile and switches the range over.
+// The source copies are deleted last. Every step is safe to repeat, so a
+// move that fails or is cut short by a restart is simply run again.
+func (s *BalancerServer) runMove(ctx context.Context) error {
+	rb := s.rebalance
+	rb.mu.Lock()
+	j := rb.move
+	if j == nil || rb.running {
+		rb.mu.Unlock()
+		return nil
+	}
+	rb.running = true
+	rb.mu.Unlock()
+
+	err := s.driveMove(ctx, j)
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.running = false
+	rb.lastErr = err
+	if err == nil {
+		log.Printf("move %s done\n", j.ID)
+		rb.move = nil
+	}
+	return err
+}
+
+func (s *BalancerServer) driveMove(ctx context.Context, j *moveJournal) error {
+	if j.Phase == movePhaseCopying {
+		for _, k := range j.Keys {
+			if err := s.moveKey(ctx, j, k, false); err != nil {
+				return err
+			}
+			s.rebalance.mu.Lock()
+			s.rebalance.copied++
+			s.rebalance.mu.Unlock()
+		}
+		if err := s.switchRange(ctx, j); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range s.cleanupKeys(j) {
+		if err := s.cleanKey(ctx, j, k); err != nil {
+			return err
+		}
+	}
+	return s.deleteMeta(ctx, moveJournalKey)
+}
+
+// switchRange copies the keys written during the copy and hands the range to
+// the target, with every write held off so none can land on the source after
+// its last copy.
+func (s *BalancerServer) switchRange(ctx context.Context, j *moveJournal) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	rb := s.rebalance
+	rb.mu.Lock()
+	keys := make([]string, 0, len(rb.dirty))
+	for k := range rb.dirty {
+		keys = append(keys, k)
+	}
+	resumed := rb.resumed
+	rb.mu.Unlock()
+	if resumed {
+		// writes before we picked the move up went untracked
+		keys = append(keys, j.Keys...)
+		keys = append(keys, s.index.keysWhere(j.covers)...)
+	}
+	for _, k := range keys {
+		if err := s.moveKey(ctx, j, k, true); err != nil {
+			return err
+		}
+	}
+
+	next := s.routes.Load().split(j.Start, j.Target)
+	if err := s.saveMeta(ctx, routesKey, next); err != nil {
+		return err
+	}
+	s.routes.Store(next)
+	// the range may have moved while the writes were held, leaving watchers
+	// with a stale view is worse than making them resume
+	s.watches.cancelAll(cancelReasonLeader)
+
+	rb.mu.Lock()
+	j.Phase = movePhaseCleaning
+	rb.mu.Unlock()
+	log.Printf("move %s switched tokens %d-%d to %s\n", j.ID, j.Start, j.End, j.Target)
+	return s.saveMeta(ctx, moveJournalKey, j)
+}
+
+// cleanupKeys returns every key that may have been left on the source.
+func (s *BalancerServer) cleanupKeys(j *moveJournal) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	add := func(k string) {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range j.Keys {
+		add(k)
+	}
+	s.rebalance.mu.Lock()
+	for k := range s.rebalance.dirty {
+		add(k)
+	}
+	s.rebalance.mu.Unlock()
+	for _, k := range s.index.keysWhere(j.covers) {
+		add(k)
+	}
+	return keys
+}
+
+// moveKey copies a key from the source to the target. With sync set a key
+// missing from the source is removed from the target too, since it was
+// deleted after being copied.
+func (s *BalancerServer) moveKey(ctx context.Context, j *moveJournal, key string, sync bool) error {
+	ctx, cancel := context.WithTimeout(ctx, moveKeyTimeout)
+	defer cancel()
+
+	var (
+		val string
+		ok  bool
+	)
+	if err := s.withLeader(ctx, j.Source, func(ctx context.Context, leader *Client) (err error) {
+		val, ok, err = fetchValue(ctx, leader, key)
+		return err
+	}); err != nil {
+		return err
+	}
+	return s.withLeader(ctx, j.Target, func(ctx context.Context, leader *Client) error {
+		if ok {
+			_, err := leader.Insert(ctx, &workerApi.InsertRequest{Key: key, Value: val})
+			return err
+		}
+		if !sync {
+			return nil
+		}
+		_, exists, err := fetchValue(ctx, leader, key)
+		if err != nil || !exists {
+			return err
+		}
+		_, err = leader.Delete(ctx, &workerApi.DeleteRequest{Key: key})
+		return err
+	})
+}
+
+// cleanKey deletes a moved key from the source.
+func (s *BalancerServer) cleanKey(ctx context.Context, j *moveJournal, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, moveKeyTimeout)
+	defer cancel()
+
+	return s.withLeader(ctx, j.Source, func(ctx context.Context, leader *Client) error {
+		_, exists, err := fetchValue(ctx, leader, key)
+		if err != nil || !exists {
+			return err
+		}
+		_, err = leader.Delete(ctx, &workerApi.DeleteRequest{Key: key})
+		return err
+	})
+}
+
+// moveStatus describes the move in flight, nil when there is none.
+func (s *BalancerServer) moveStatus() *v1.ShardMove {
+	rb := s.rebalance
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.move == nil {
+		return nil
+	}
+	m := &v1.ShardMove{
+		Id:      rb.move.ID,
+		Source:  rb.move.Source,
+		Target:  rb.move.Target,
+		Start:   rb.move.Start,
+		End:     rb.move.End,
+		Phase:   rb.move.Phase,
+		Copied:  rb.copied,
+		Total:   int64(len(rb.move.Keys)),
+		Resumed: rb.resumed,
+	}
+	if rb.lastErr != nil {
+		m.Error = rb.lastErr.Error()
+	}
+	return m
+}
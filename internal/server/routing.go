@@ -0,0 +1,153 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+)
+
+// routing is an immutable view of the workers, the shard each one serves and
+// the leader of each shard. Requests load the current view without locking,
+// changes copy it and swap the copy in under s.mu.
+type routing struct {
+	workers map[string]*Client
+	// shardOf maps each placed worker to its shard.
+	shardOf map[string]string
+	// leaders maps each shard to the worker leading its raft group.
+	leaders map[string]string
+}
+
+func newRouting() *routing {
+	return &routing{
+		workers: make(map[string]*Client),
+		shardOf: make(map[string]string),
+		leaders: make(map[string]string),
+	}
+}
+
+func (r *routing) clone() *routing {
+	next := newRouting()
+	for k, v := range r.workers {
+		next.workers[k] = v
+	}
+	for k, v := range r.shardOf {
+		next.shardOf[k] = v
+	}
+	for k, v := range r.leaders {
+		next.leaders[k] = v
+	}
+	return next
+}
+
+// routing returns the current view, it must not be modified.
+func (s *BalancerServer) routing() *routing {
+	return s.state.Load()
+}
+
+// update applies fn to a copy of the current view and publishes it. fn must
+// not block, in particular it must not call the workers. Watchers are
+// cancelled when a shard changes leader so clients resume against the new
+// leader from their last seen revision.
+func (s *BalancerServer) update(fn func(r *routing)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.state.Load()
+	next := prev.clone()
+	fn(next)
+	s.state.Store(next)
+
+	for id, leader := range next.leaders {
+		if prev.leaders[id] != leader {
+			s.watches.cancelAll(cancelReasonLeader)
+			break
+		}
+	}
+	s.memberEvents.notify()
+}
+
+// setLeader points writes for a shard at a new leader, an empty serverID
+// means the shard has no known leader.
+func (r *routing) setLeader(shardID, serverID string) {
+	if serverID == "" {
+		delete(r.leaders, shardID)
+		return
+	}
+	r.leaders[shardID] = serverID
+}
+
+// shardWorkers returns the workers assigned to a shard, including those still
+// being onboarded.
+func (r *routing) shardWorkers(shardID string) []*Client {
+	var ret []*Client
+	for id, c := range r.workers {
+		if r.shardOf[id] == shardID {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// activeWorkers returns the workers of a shard that have joined its raft group.
+func (r *routing) activeWorkers(shardID string) []*Client {
+	var ret []*Client
+	for _, c := range r.shardWorkers(shardID) {
+		if c.onboarding.is(stateActive) {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+func (r *routing) shardLeader(shardID string) (*Client, bool) {
+	leader, ok := r.workers[r.leaders[shardID]]
+	if !ok || r.shardOf[leader.ServerID] != shardID {
+		return nil, false
+	}
+	return leader, true
+}
+
+// leads reports whether a worker leads the shard it is placed in.
+func (r *routing) leads(serverID string) bool {
+	shardID, ok := r.shardOf[serverID]
+	return ok && r.leaders[shardID] == serverID
+}
+
+// knownShards returns every shard that owns keys in rt or has workers, in order.
+func (r *routing) knownShards(rt *routeTable) []string {
+	seen := make(map[string]bool)
+	for _, id := range rt.shards() {
+		seen[id] = true
+	}
+	for _, id := range r.shardOf {
+		seen[id] = true
+	}
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return shardNumber(ids[i]) < shardNumber(ids[j])
+	})
+	return ids
+}
+
+// emptiestShard returns the shard with the fewest workers. Once every shard
+// has shardSize workers a new shard is formed, which owns no keys until the
+// rebalancer hands it a range.
+func (r *routing) emptiestShard(rt *routeTable, shardSize int) string {
+	ids := r.knownShards(rt)
+	best, bestCount := "", -1
+	for _, id := range ids {
+		if n := len(r.shardWorkers(id)); bestCount == -1 || n < bestCount {
+			best, bestCount = id, n
+		}
+	}
+	if shardSize > 0 && bestCount >= shardSize {
+		return fmt.Sprintf("shard-%d", shardNumber(ids[len(ids)-1])+1)
+	}
+	return best
+}
+
+func (s *BalancerServer) knownShards() []string {
+	return s.routing().knownShards(s.routes.Load())
+}
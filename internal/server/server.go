@@ -5,23 +5,56 @@ import (
 	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+	"github.com/izaakdale/dinghy-agent/internal/certs"
+	"github.com/izaakdale/dinghy-agent/internal/tokens"
 
 	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+	"google.golang.org/grpc/credentials"
 )
 
-var ErrNoServers = errors.New("no servers to carry out request")
+var (
+	ErrNoServers      = errors.New("no servers to carry out request")
+	ErrLeaseNotFound  = errors.New("requested lease not found")
+	ErrInvalidRequest = errors.New("invalid request")
+)
 
 var _ v1.AgentServer = (*BalancerServer)(nil)
 
 type BalancerServer struct {
 	v1.UnimplementedAgentServer
-	mu              sync.Mutex
-	workers         map[string]*Client
-	leaderID        string
-	currentWorkerID string
+	// mu serialises changes to state, readers load it without locking.
+	mu    sync.Mutex
+	state atomic.Pointer[routing]
+	// routes is swapped whole when a move switches a range to its new shard.
+	routes    atomic.Pointer[routeTable]
+	shardSize int
+	rebalance *rebalancer
+	// adopting holds workers found through heartbeats that are being added.
+	adopting sync.Map
+	// claims holds workers whose leadership claims are being checked.
+	claims       sync.Map
+	serfMu       sync.Mutex
+	serfMembers  map[string]serfMember
+	memberEvents *memberNotifier
+	conns        *connPool
+	picker       Picker
+	index        *keyIndex
+	watches      *watchHub
+	leases       *lessor
+	peers        *peers
+	election     *election
+	peerIdentity certs.Identity
+	store        *indexStore
+	auth         *authStore
+	keyring      atomic.Pointer[Keyring]
+	// writeMu is shared by plain writes and held exclusively by transactions.
+	writeMu sync.RWMutex
+	// commitMu keeps revisions and watch events in the same order.
+	commitMu sync.Mutex
 }
 
 type Client struct {
@@ -29,76 +62,200 @@ type Client struct {
 	GRPCAddr string
 	RaftAddr string
 	workerApi.WorkerClient
+	conn   *workerConn
+	stats  *clientStats
+	health *clientHealth
+	// lastHeartbeat is the unix nano time of the worker's last serf heartbeat.
+	lastHeartbeat atomic.Int64
+	// draining keeps the worker out of read rotation for maintenance.
+	draining   atomic.Bool
+	onboarding *onboarding
+	// stop ends the health probe
+	stop chan struct{}
 }
 
-func New() *BalancerServer {
-	return &BalancerServer{
-		leaderID: "",
-		workers:  make(map[string]*Client),
-	}
+type Config struct {
+	// Name is the agent's serf node name, which the coordinator lease is held
+	// under.
+	Name string
+	// Picker spreads reads over the followers, round robin when nil.
+	Picker Picker
+	// Shards is the number of raft groups the keyspace is split across.
+	Shards int
+	// ShardSize is the number of workers per raft group, workers beyond it
+	// form a new group. Zero spreads every worker over the existing groups.
+	ShardSize int
+	// WorkerCredentials secure the connections to the workers, plaintext when nil.
+	WorkerCredentials credentials.TransportCredentials
+	// PeerCredentials secure the connections to the other agents, plaintext
+	// when nil. They have to match the agents' listeners.
+	PeerCredentials credentials.TransportCredentials
+	// PeerIdentity is what the other agents' client certificates show.
+	// Forwarded requests and the identities they carry are only trusted from
+	// callers showing it.
+	PeerIdentity certs.Identity
+	// Auth turns on the per prefix permissions of the auth interceptors.
+	Auth bool
+	// RootUsers are client certificate identities that hold the root role.
+	RootUsers []string
+	// Tokens verifies signed bearer tokens, which are rejected when nil.
+	Tokens *tokens.Verifier
 }
 
-func (b *BalancerServer) HeartbeatHandler(server *workerApi.ServerHeartbeat) {
-	if server.IsLeader && b.leaderID != server.Name {
-		log.Printf("new leadership claim from %s\n", server.Name)
-		b.leaderID = server.Name
+func New(cfg Config) *BalancerServer {
+	if cfg.Picker == nil {
+		cfg.Picker = &roundRobinPicker{}
 	}
 
-	if _, ok := b.workers[server.Name]; !ok {
+	s := &BalancerServer{
+		shardSize:    cfg.ShardSize,
+		rebalance:    &rebalancer{},
+		serfMembers:  make(map[string]serfMember),
+		memberEvents: newMemberNotifier(),
+		conns:        newConnPool(cfg.WorkerCredentials),
+		picker:       cfg.Picker,
+		peers:        newPeers(cfg.Name, cfg.PeerCredentials),
+		election:     &election{},
+		peerIdentity: cfg.PeerIdentity,
+		auth:         newAuthStore(cfg.Auth, cfg.RootUsers, cfg.Tokens),
+		index:        newKeyIndex(),
+		store:        &indexStore{},
+		watches:      newWatchHub(),
+	}
+	s.state.Store(newRouting())
+	s.routes.Store(newRouteTable(shardIDs(cfg.Shards)))
+	s.leases = newLessor(s.leaseLapsed)
+	return s
+}
+
+func (b *BalancerServer) HeartbeatHandler(server *workerApi.ServerHeartbeat) {
+	r := b.routing()
+	c, ok := r.workers[server.Name]
+	if !ok {
 		log.Printf("received a heartbeat from an unknown server - %s\n", server.Name)
 
-		leader, ok := b.workers[b.leaderID]
-		if !ok {
-			log.Printf("no leader registered\n")
+		if !b.IsCoordinator() {
+			return
+		}
+		if _, adding := b.adopting.LoadOrStore(server.Name, true); adding {
 			return
 		}
+		go func() {
+			defer b.adopting.Delete(server.Name)
+			if err := b.AddClient(server.Name, server.GrpcAddr, server.RaftAddr); err != nil {
+				log.Printf("error adding %s from heartbeat: %v\n", server.Name, err)
+			}
+		}()
+		return
+	}
 
-		leader.WorkerClient.Join(context.Background(), &workerApi.JoinRequest{
-			ServerAddr: server.RaftAddr,
-			ServerId:   server.Name,
-		})
+	c.lastHeartbeat.Store(time.Now().UnixNano())
+
+	// leadership only means something once the worker has joined its raft
+	// group, until then it leads a group of its own.
+	if c.onboarding.is(stateDiscovered, stateFailed) {
+		go b.resolveShard(c)
+		return
+	}
+	if !c.onboarding.is(stateActive) {
+		return
+	}
+	shardID := r.shardOf[server.Name]
+	if server.IsLeader && r.leaders[shardID] != server.Name {
+		if _, checking := b.claims.LoadOrStore(server.Name, true); checking {
+			return
+		}
+		go func() {
+			defer b.claims.Delete(server.Name)
+			b.confirmClaim(c, shardID)
+		}()
 	}
 }
 
 func (s *BalancerServer) Insert(ctx context.Context, request *v1.InsertRequest) (*v1.InsertResponse, error) {
-	leader, ok := s.workers[s.leaderID]
-	if !ok || leader == nil {
-		return nil, ErrNoServers
+	if err := checkValue(request.Value); err != nil {
+		return nil, err
+	}
+	if err := s.put(ctx, request); err != nil {
+		return nil, err
+	}
+	return &v1.InsertResponse{}, nil
+}
+
+// put writes a value that has already been checked, or encoded by the v2 api.
+func (s *BalancerServer) put(ctx context.Context, request *v1.InsertRequest) error {
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	return s.withLeader(ctx, s.keyShard(request.Key), func(ctx context.Context, leader *Client) error {
+		log.Printf("insert served by %s\n", leader.ServerID)
+		return s.insertTo(ctx, leader, request)
+	})
+}
+
+// insertTo writes to leader and records the write. Callers hold writeMu and
+// have checked the value.
+func (s *BalancerServer) insertTo(ctx context.Context, leader *Client, request *v1.InsertRequest) error {
+	if err := checkKey(request.Key); err != nil {
+		return err
+	}
+	if request.Lease != 0 && !s.leases.exists(request.Lease) {
+		return ErrLeaseNotFound
+	}
+	if err := s.track(ctx, request.Key); err != nil {
+		return err
 	}
-	log.Printf("insert served by %s\n", leader.ServerID)
 
-	ctx, cancel := context.WithTimeout(ctx, time.Second)
-	defer cancel()
 	_, err := leader.Insert(ctx, &workerApi.InsertRequest{
 		Key:   request.Key,
 		Value: request.Value,
 	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	return &v1.InsertResponse{}, nil
+	err = s.record(ctx, v1.Event_PUT, request.Key, request.Value, request.Lease)
+	if errors.Is(err, ErrLeaseNotFound) {
+		s.dropUnleased(ctx, leader, request.Key)
+	}
+	return err
 }
 
 func (s *BalancerServer) Delete(ctx context.Context, request *v1.DeleteRequest) (*v1.DeleteResponse, error) {
-	leader, ok := s.workers[s.leaderID]
-	if !ok || leader == nil {
-		return nil, ErrNoServers
+	if err := s.remove(ctx, request.Key); err != nil {
+		return nil, err
 	}
-	log.Printf("delete served by %s\n", leader.ServerID)
+	return &v1.DeleteResponse{}, nil
+}
+
+func (s *BalancerServer) remove(ctx context.Context, key string) error {
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+
+	return s.withLeader(ctx, s.keyShard(key), func(ctx context.Context, leader *Client) error {
+		log.Printf("delete served by %s\n", leader.ServerID)
+		return s.deleteFrom(ctx, leader, key)
+	})
+}
 
+// deleteFrom deletes from leader and records the delete. Callers hold writeMu.
+func (s *BalancerServer) deleteFrom(ctx context.Context, leader *Client, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
 	_, err := leader.Delete(ctx, &workerApi.DeleteRequest{
-		Key: request.Key,
+		Key: key,
 	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	return &v1.DeleteResponse{}, nil
+	return s.record(ctx, v1.Event_DELETE, key, "", 0)
 }
 
 func (s *BalancerServer) Fetch(ctx context.Context, request *v1.FetchRequest) (*v1.FetchResponse, error) {
-	f, err := s.nextFollower()
+	if err := checkKey(request.Key); err != nil {
+		return nil, err
+	}
+	f, err := s.readTarget(ctx, request)
 	if err != nil {
 		return nil, err
 	}
@@ -117,32 +274,83 @@ func (s *BalancerServer) Fetch(ctx context.Context, request *v1.FetchRequest) (*
 	}, nil
 }
 
+// track stores a key in the index before its first write reaches a worker.
+// Should the write then fail to be recorded the key is still listed and moved
+// with its range, only its metadata lags behind. Deletes need no tracking,
+// one that fails to be recorded leaves a key in the index that is gone from
+// the worker, which listings and moves skip.
+func (s *BalancerServer) track(ctx context.Context, key string) error {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	if s.index.has(key) {
+		return nil
+	}
+	if err := s.appendState(ctx, stateEntry{Op: stateOpTouch, Key: key}); err != nil {
+		return err
+	}
+	s.index.touch(key)
+	return nil
+}
+
+// record stores a write acknowledged by the leader and applies it to the key
+// index, moves the key between leases and notifies any watchers. If the
+// write's lease lapsed while it was in flight ErrLeaseNotFound is returned and
+// nothing is recorded, see dropUnleased.
+func (s *BalancerServer) record(ctx context.Context, typ v1.Event_EventType, key, value string, lease int64) error {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	// attaching under the lessor lock means the lease either takes the key
+	// with it when it lapses or is already gone
+	if !s.leases.attach(lease, key) {
+		return ErrLeaseNotFound
+	}
+	e := stateEntry{Op: stateOpPut, Key: key, Lease: lease}
+	if typ == v1.Event_DELETE {
+		e = stateEntry{Op: stateOpDelete, Key: key}
+	}
+	if err := s.appendState(ctx, e); err != nil {
+		if m, _ := s.index.get(key); m.lease != lease {
+			s.leases.detach(lease, key)
+		}
+		return err
+	}
+
+	var rev, prevLease int64
+	if typ == v1.Event_DELETE {
+		rev, prevLease = s.index.delete(key)
+	} else {
+		rev, prevLease = s.index.put(key, lease)
+	}
+	if prevLease != lease {
+		s.leases.detach(prevLease, key)
+	}
+	s.watches.publish(&v1.Event{
+		Type:        typ,
+		Kv:          &v1.KeyValue{Key: key, Value: value},
+		ModRevision: rev,
+	})
+	s.rebalance.touch(key)
+	return nil
+}
+
 func (s *BalancerServer) Memberlist(context.Context, *v1.MemberlistRequest) (*v1.MemberlistResponse, error) {
 	members := s.GetMembers()
 	if members == nil {
 		return &v1.MemberlistResponse{}, nil
 	}
 
-	return &v1.MemberlistResponse{
+	resp := &v1.MemberlistResponse{
 		Leader:    members.Leader,
 		Followers: members.Followers,
-	}, nil
-}
-
-func (b *BalancerServer) nextFollower() (*Client, error) {
-	if len(b.workers) == 0 {
-		return nil, ErrNoServers
 	}
-
-	for _, c := range b.workers {
-		if len(b.workers) == 1 {
-			return c, nil
-		}
-		if c.ServerID != b.currentWorkerID && c.ServerID != b.leaderID {
-			b.currentWorkerID = c.ServerID
-			return c, nil
-		}
+	for _, sh := range members.Shards {
+		resp.Shards = append(resp.Shards, &v1.ShardMembers{
+			Id:        sh.ID,
+			Leader:    sh.Leader,
+			Followers: sh.Followers,
+		})
 	}
-	// reaching here is technically impossible, but still return nil
-	return nil, errors.New("this should be investigated")
+	return resp, nil
 }
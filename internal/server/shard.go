@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// reservedPrefix holds keys the agent keeps for itself on the workers,
+	// clients can neither read nor write under it.
+	reservedPrefix = "\x00dinghy/"
+	// shardIdentityKey is written to every raft group when it is formed and
+	// replicates to each worker that joins, so any agent can ask a worker
+	// which shard it belongs to, even after agents restart.
+	shardIdentityKey = reservedPrefix + "shard"
+	// metaShard holds the routing table and move journal, it is never moved.
+	metaShard = "shard-0"
+)
+
+// shardIDs names the shards of a cluster with n raft groups.
+func shardIDs(n int) []string {
+	if n < 1 {
+		n = 1
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("shard-%d", i)
+	}
+	return ids
+}
+
+// token places a key on the hash ring.
+func token(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// tokenRange owns the tokens from start up to the start of the next range.
+type tokenRange struct {
+	start uint32
+	shard string
+}
+
+// routeTable splits the hash ring into contiguous ranges of tokens, each
+// owned by a shard. Hashing spreads keys evenly, while ranges let a shard
+// hand part of its keys to another by splitting.
+type routeTable struct {
+	ranges []tokenRange
+}
+
+// newRouteTable splits the ring evenly between shards.
+func newRouteTable(shards []string) *routeTable {
+	width := (uint64(math.MaxUint32) + 1) / uint64(len(shards))
+	r := &routeTable{}
+	for i, id := range shards {
+		r.ranges = append(r.ranges, tokenRange{
+			start: uint32(uint64(i) * width),
+			shard: id,
+		})
+	}
+	return r
+}
+
+func (r *routeTable) shardFor(key string) string {
+	return r.ranges[r.rangeOf(token(key))].shard
+}
+
+// rangeOf returns the index of the range owning token t.
+func (r *routeTable) rangeOf(t uint32) int {
+	i := sort.Search(len(r.ranges), func(i int) bool {
+		return r.ranges[i].start > t
+	})
+	return i - 1
+}
+
+// end returns the exclusive end of the i'th range.
+func (r *routeTable) end(i int) uint64 {
+	if i+1 < len(r.ranges) {
+		return uint64(r.ranges[i+1].start)
+	}
+	return uint64(math.MaxUint32) + 1
+}
+
+// shards returns the shards owning at least one range.
+func (r *routeTable) shards() []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, tr := range r.ranges {
+		if !seen[tr.shard] {
+			seen[tr.shard] = true
+			ret = append(ret, tr.shard)
+		}
+	}
+	return ret
+}
+
+// split returns a copy of the table with the tokens from at to the end of
+// the range holding at handed to target.
+func (r *routeTable) split(at uint32, target string) *routeTable {
+	i := r.rangeOf(at)
+	ranges := make([]tokenRange, 0, len(r.ranges)+1)
+	ranges = append(ranges, r.ranges[:i]...)
+	if r.ranges[i].start != at {
+		ranges = append(ranges, r.ranges[i])
+	}
+	ranges = append(ranges, tokenRange{start: at, shard: target})
+	ranges = append(ranges, r.ranges[i+1:]...)
+	return &routeTable{ranges: ranges}
+}
+
+type routeEntry struct {
+	Start uint32 `json:"start"`
+	Shard string `json:"shard"`
+}
+
+func (r *routeTable) MarshalJSON() ([]byte, error) {
+	entries := make([]routeEntry, len(r.ranges))
+	for i, tr := range r.ranges {
+		entries[i] = routeEntry{Start: tr.start, Shard: tr.shard}
+	}
+	return json.Marshal(entries)
+}
+
+func (r *routeTable) UnmarshalJSON(b []byte) error {
+	var entries []routeEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	if len(entries) == 0 || entries[0].Start != 0 {
+		return fmt.Errorf("routing table must start at token 0")
+	}
+	r.ranges = make([]tokenRange, len(entries))
+	for i, e := range entries {
+		if i > 0 && e.Start <= entries[i-1].Start {
+			return fmt.Errorf("routing table is out of order at token %d", e.Start)
+		}
+		r.ranges[i] = tokenRange{start: e.Start, shard: e.Shard}
+	}
+	return nil
+}
+
+// checkKey turns away client requests for reserved keys.
+func checkKey(key string) error {
+	if strings.HasPrefix(key, reservedPrefix) {
+		return fmt.Errorf("%w: keys under %q are reserved", ErrInvalidRequest, reservedPrefix)
+	}
+	return nil
+}
+
+// checkValue turns away values the agent keeps for itself, the tombstone and
+// anything the v2 api would read back as base64 encoded bytes.
+func checkValue(value string) error {
+	if value == tombstoneValue {
+		return fmt.Errorf("%w: the value %q is reserved", ErrInvalidRequest, value)
+	}
+	if strings.HasPrefix(value, binaryValuePrefix) {
+		return fmt.Errorf("%w: values may not start with %q", ErrInvalidRequest, binaryValuePrefix)
+	}
+	return nil
+}
+
+func (s *BalancerServer) keyShard(key string) string {
+	return s.routes.Load().shardFor(key)
+}
+
+func shardNumber(shardID string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(shardID, "shard-"))
+	return n
+}
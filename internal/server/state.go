@@ -0,0 +1,683 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// stateKey holds the header of the key index stored in the meta shard.
+	stateKey = reservedPrefix + "state"
+	// statePagePrefix holds the pages of the snapshot. Each page has two
+	// slots and is rewritten to the one the header does not point at.
+	statePagePrefix = reservedPrefix + "state/page/"
+	// stateLeasePrefix holds the leases of the snapshot, in two slots.
+	stateLeasePrefix = reservedPrefix + "state/lease/"
+	// stateLogPrefix holds the changes made since the snapshot, in a ring.
+	stateLogPrefix = reservedPrefix + "state/log/"
+
+	// statePageBytes caps the encoded size of a snapshot page, well below
+	// the largest message the workers take.
+	statePageBytes = 256 << 10
+	// stateSnapshotEvery is the number of changes after which the index is
+	// snapshotted again.
+	stateSnapshotEvery = 1000
+	// stateLogSlots is the size of the change ring. Writes are turned away
+	// rather than overwrite changes no snapshot holds yet.
+	stateLogSlots = 4 * stateSnapshotEvery
+	// stateSnapshotTimeout bounds writing a snapshot.
+	stateSnapshotTimeout = time.Minute
+	// stateSnapshotRetry is how long a failed snapshot waits to be retried.
+	stateSnapshotRetry = 5 * time.Second
+)
+
+const (
+	stateOpPut    = "put"
+	stateOpDelete = "delete"
+	// stateOpTouch is stored before a new key is first written, see track.
+	stateOpTouch = "touch"
+	// stateOpComplete is stored once the index is declared complete.
+	stateOpComplete = "complete"
+	stateOpGrant    = "grant"
+	stateOpRevoke   = "revoke"
+)
+
+var ErrIndexUnavailable = errors.New("key index is not available")
+
+// stateHeader says where the stored index is. Workers have no listing, so
+// the index and the leases are kept as a snapshot and a ring of the changes
+// made since, both overwritten in place. The snapshot is split into pages
+// by key and only the pages changed since the last one are written again.
+type stateHeader struct {
+	Owner    string `json:"owner"`
+	Epoch    int64  `json:"epoch"`
+	Seq      int64  `json:"seq"`
+	Revision int64  `json:"revision"`
+	// Complete is set once the index is declared to hold every key. Workers
+	// cannot list their keys, so an index starts out incomplete in case they
+	// held keys before it was stored, see completeIndex.
+	Complete bool `json:"complete"`
+	// Pages lists the stored key pages in key order.
+	Pages    []statePage `json:"pages,omitempty"`
+	NextPage int         `json:"next_page"`
+	// LeaseSlot and LeasePages say where the leases are stored.
+	LeaseSlot  int `json:"lease_slot"`
+	LeasePages int `json:"lease_pages"`
+}
+
+// statePage is where a page of keys is stored.
+type statePage struct {
+	ID   int `json:"id"`
+	Slot int `json:"slot"`
+}
+
+// stateLease is a lease as granted, the time left on it is not stored.
+type stateLease struct {
+	TTL time.Duration `json:"ttl"`
+	// Owner is the user that granted the lease, empty without auth.
+	Owner string `json:"owner,omitempty"`
+}
+
+// stateLeaseEntry is a stateLease as stored in a lease page.
+type stateLeaseEntry struct {
+	ID int64 `json:"id"`
+	stateLease
+}
+
+// stateKeyMeta is a keyMeta as stored in a snapshot page.
+type stateKeyMeta struct {
+	Key            string `json:"key"`
+	CreateRevision int64  `json:"create"`
+	ModRevision    int64  `json:"mod"`
+	Version        int64  `json:"version"`
+	Lease          int64  `json:"lease,omitempty"`
+}
+
+// stateEntry is a change to the index. Seq numbers the changes without gaps,
+// Epoch is bumped by each coordinator taking the index over so changes a
+// replaced coordinator wrote late are not read back.
+type stateEntry struct {
+	Seq   int64         `json:"seq"`
+	Epoch int64         `json:"epoch"`
+	Op    string        `json:"op"`
+	Key   string        `json:"key,omitempty"`
+	Lease int64         `json:"lease,omitempty"`
+	TTL   time.Duration `json:"ttl,omitempty"`
+	Owner string        `json:"owner,omitempty"`
+}
+
+// indexStore tracks the stored index on the coordinator.
+type indexStore struct {
+	// loadMu serialises loading the index from the meta shard.
+	loadMu sync.Mutex
+
+	mu       sync.Mutex
+	loaded   bool
+	complete bool
+	epoch    int64
+	// seq is the last change stored, snapSeq the last one the snapshot holds.
+	seq     int64
+	snapSeq int64
+	// pages are the key pages of the snapshot in key order, the first one
+	// starts at the empty key.
+	pages    []*pageState
+	nextPage int
+	// leasesDirty is set once a lease is granted or revoked after the
+	// snapshot was taken.
+	leaseSlot   int
+	leasePages  int
+	leasesDirty bool
+
+	snapshotting bool
+	// snapErr is why the last snapshot failed, it is not retried before
+	// snapRetry.
+	snapErr   error
+	snapRetry time.Time
+}
+
+// pageState is a page of keys holding those from its first key up to the
+// next page's. A page that changed since the snapshot is dirty, one that
+// held no keys when it was last written is not stored.
+type pageState struct {
+	id     int
+	first  string
+	slot   int
+	stored bool
+	dirty  bool
+}
+
+func statePageKey(id, slot int) string {
+	return fmt.Sprintf("%s%d/%d", statePagePrefix, id, slot)
+}
+
+func stateLeaseKey(slot, page int) string {
+	return fmt.Sprintf("%s%d/%d", stateLeasePrefix, slot, page)
+}
+
+func stateLogKey(seq int64) string {
+	return fmt.Sprintf("%s%d", stateLogPrefix, seq%stateLogSlots)
+}
+
+// pageOf returns the page key falls in.
+func pageOf(pages []*pageState, key string) *pageState {
+	i := sort.Search(len(pages), func(i int) bool { return pages[i].first > key })
+	return pages[i-1]
+}
+
+// markDirty notes the part of the snapshot a change makes stale, reporting
+// whether it is the leases.
+func markDirty(pages []*pageState, e stateEntry) bool {
+	switch e.Op {
+	case stateOpPut, stateOpDelete, stateOpTouch:
+		pageOf(pages, e.Key).dirty = true
+	case stateOpGrant, stateOpRevoke:
+		return true
+	}
+	return false
+}
+
+// chunkBySize splits items into runs of at most statePageBytes encoded, an
+// item too large for a page of its own still gets one.
+func chunkBySize[T any](items []T) ([][]T, error) {
+	var (
+		chunks [][]T
+		cur    []T
+		size   int
+	)
+	for _, item := range items {
+		b, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		if len(cur) > 0 && size+len(b)+1 > statePageBytes {
+			chunks, cur, size = append(chunks, cur), nil, 0
+		}
+		cur, size = append(cur, item), size+len(b)+1
+	}
+	if len(cur) > 0 {
+		chunks = append(chunks, cur)
+	}
+	return chunks, nil
+}
+
+// isComplete reports whether the index holds every key in the cluster.
+func (st *indexStore) isComplete() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.complete
+}
+
+func (st *indexStore) isLoaded() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.loaded
+}
+
+// ensureState loads the stored index the first time it is needed after this
+// agent became coordinator.
+func (s *BalancerServer) ensureState(ctx context.Context) error {
+	st := s.store
+	st.loadMu.Lock()
+	defer st.loadMu.Unlock()
+	if st.isLoaded() {
+		return nil
+	}
+	if !s.IsCoordinator() {
+		return fmt.Errorf("%w: not the coordinator", ErrIndexUnavailable)
+	}
+	return s.loadState(ctx)
+}
+
+// loadState reads the snapshot and the changes since from the meta shard,
+// takes the index and leases over and swaps them in. Watchers resuming from
+// before the loaded revision are told it has been compacted, the events
+// leading up to it are not stored. The previous coordinator's lease ran out
+// before ours began, so it no longer writes to the meta shard.
+func (s *BalancerServer) loadState(ctx context.Context) error {
+	h, err := s.fetchStateHeader(ctx)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		// the workers may hold keys written before the index was stored
+		h = &stateHeader{}
+		log.Printf("no stored key index, listings will be partial until it is declared complete\n")
+	}
+
+	idx := newKeyIndex()
+	idx.rev = h.Revision
+	var pages []*pageState
+	for i, ref := range h.Pages {
+		val, ok, err := s.fetchMeta(ctx, statePageKey(ref.ID, ref.Slot))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: page %d of the snapshot is missing", ErrIndexUnavailable, ref.ID)
+		}
+		var page []stateKeyMeta
+		if err := json.Unmarshal([]byte(val), &page); err != nil {
+			return fmt.Errorf("bad index page %d: %w", ref.ID, err)
+		}
+		for _, m := range page {
+			idx.tree.ReplaceOrInsert(&keyMeta{
+				key:            m.Key,
+				createRevision: m.CreateRevision,
+				modRevision:    m.ModRevision,
+				version:        m.Version,
+				lease:          m.Lease,
+			})
+		}
+		ps := &pageState{id: ref.ID, slot: ref.Slot, stored: true}
+		if i > 0 {
+			if len(page) == 0 {
+				continue
+			}
+			ps.first = page[0].Key
+		}
+		pages = append(pages, ps)
+	}
+	nextPage := h.NextPage
+	if len(pages) == 0 {
+		pages = append(pages, &pageState{id: nextPage})
+		nextPage++
+	}
+
+	leases := make(map[int64]stateLease)
+	for p := 0; p < h.LeasePages; p++ {
+		val, ok, err := s.fetchMeta(ctx, stateLeaseKey(h.LeaseSlot, p))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: lease page %d of the snapshot is missing", ErrIndexUnavailable, p)
+		}
+		var page []stateLeaseEntry
+		if err := json.Unmarshal([]byte(val), &page); err != nil {
+			return fmt.Errorf("bad lease page %d: %w", p, err)
+		}
+		for _, l := range page {
+			leases[l.ID] = l.stateLease
+		}
+	}
+
+	// the changes replayed are not in the snapshot yet
+	seq, epoch := h.Seq, h.Epoch
+	leasesDirty := false
+	for {
+		val, ok, err := s.fetchMeta(ctx, stateLogKey(seq+1))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		var e stateEntry
+		if err := json.Unmarshal([]byte(val), &e); err != nil {
+			return fmt.Errorf("bad index change %d: %w", seq+1, err)
+		}
+		// the slot still holds a change from an earlier lap of the ring, or
+		// one a replaced coordinator wrote after we took over
+		if e.Seq != seq+1 || e.Epoch < epoch {
+			break
+		}
+		seq, epoch = e.Seq, e.Epoch
+		if e.Op == stateOpComplete {
+			h.Complete = true
+		}
+		applyStateEntry(idx, leases, e)
+		if markDirty(pages, e) {
+			leasesDirty = true
+		}
+	}
+
+	h.Owner, h.Epoch = s.peers.self, epoch+1
+	if err := s.saveMeta(ctx, stateKey, h); err != nil {
+		return err
+	}
+	log.Printf("loaded key index at revision %d with %d leases and %d changes since the snapshot\n", idx.rev, len(leases), seq-h.Seq)
+
+	s.commitMu.Lock()
+	s.leases.restore(leases, idx.leaseKeys())
+	s.index.replace(idx)
+	s.watches.reset(idx.rev)
+	st := s.store
+	st.mu.Lock()
+	st.loaded, st.complete = true, h.Complete
+	st.epoch, st.seq, st.snapSeq = h.Epoch, seq, h.Seq
+	st.pages, st.nextPage = pages, nextPage
+	st.leaseSlot, st.leasePages, st.leasesDirty = h.LeaseSlot, h.LeasePages, leasesDirty
+	st.snapErr, st.snapRetry = nil, time.Time{}
+	st.mu.Unlock()
+	s.commitMu.Unlock()
+	return nil
+}
+
+func (s *BalancerServer) fetchStateHeader(ctx context.Context) (*stateHeader, error) {
+	val, ok, err := s.fetchMeta(ctx, stateKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+	h := &stateHeader{}
+	if err := json.Unmarshal([]byte(val), h); err != nil {
+		return nil, fmt.Errorf("bad index header: %w", err)
+	}
+	return h, nil
+}
+
+func applyStateEntry(idx *keyIndex, leases map[int64]stateLease, e stateEntry) {
+	switch e.Op {
+	case stateOpPut:
+		idx.put(e.Key, e.Lease)
+	case stateOpDelete:
+		idx.delete(e.Key)
+	case stateOpTouch:
+		idx.touch(e.Key)
+	case stateOpGrant:
+		leases[e.Lease] = stateLease{TTL: e.TTL, Owner: e.Owner}
+	case stateOpRevoke:
+		delete(leases, e.Lease)
+	}
+}
+
+// completeIndex declares that the index holds every key.
+func (s *BalancerServer) completeIndex(ctx context.Context) error {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+
+	if s.store.isComplete() {
+		return nil
+	}
+	if err := s.appendState(ctx, stateEntry{Op: stateOpComplete}); err != nil {
+		return err
+	}
+	st := s.store
+	st.mu.Lock()
+	st.complete = true
+	st.mu.Unlock()
+	log.Printf("key index declared complete\n")
+	return nil
+}
+
+// resignState drops the index and leases once another agent coordinates, they
+// are loaded again from the meta shard should this agent take back over.
+func (s *BalancerServer) resignState() {
+	st := s.store
+	st.mu.Lock()
+	loaded := st.loaded
+	st.loaded = false
+	st.mu.Unlock()
+	if !loaded {
+		return
+	}
+
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+	s.leases.reset()
+	s.index.replace(newKeyIndex())
+	s.watches.reset(0)
+}
+
+// appendState stores a change before it is applied to the index. Callers hold
+// commitMu, so changes are stored in the order they are applied.
+func (s *BalancerServer) appendState(ctx context.Context, e stateEntry) error {
+	if !s.IsCoordinator() {
+		return fmt.Errorf("%w: not the coordinator", ErrIndexUnavailable)
+	}
+
+	st := s.store
+	st.mu.Lock()
+	if !st.loaded {
+		st.mu.Unlock()
+		return fmt.Errorf("%w: not loaded", ErrIndexUnavailable)
+	}
+	e.Seq, e.Epoch = st.seq+1, st.epoch
+	full, snapErr := e.Seq-st.snapSeq > stateLogSlots, st.snapErr
+	st.mu.Unlock()
+	if full {
+		s.snapshotSoon()
+		if snapErr != nil {
+			return fmt.Errorf("%w: waiting on a snapshot, the last one failed: %v", ErrIndexUnavailable, snapErr)
+		}
+		return fmt.Errorf("%w: waiting on a snapshot", ErrIndexUnavailable)
+	}
+
+	if err := s.saveMeta(ctx, stateLogKey(e.Seq), e); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	st.seq = e.Seq
+	if markDirty(st.pages, e) {
+		st.leasesDirty = true
+	}
+	due := st.seq-st.snapSeq >= stateSnapshotEvery
+	st.mu.Unlock()
+	if due {
+		s.snapshotSoon()
+	}
+	return nil
+}
+
+// snapshotSoon starts a snapshot unless one is already being written, or the
+// last one failed too recently.
+func (s *BalancerServer) snapshotSoon() {
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.snapshotting || time.Now().Before(st.snapRetry) {
+		return
+	}
+	st.snapshotting = true
+	go func() {
+		err := s.snapshotState()
+		if err != nil {
+			log.Printf("failed to snapshot the key index: %v\n", err)
+		}
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.snapshotting, st.snapErr = false, err
+		if err != nil {
+			st.snapRetry = time.Now().Add(stateSnapshotRetry)
+		}
+	}()
+}
+
+// snapshotErr returns why the last snapshot failed, nil if it did not.
+func (st *indexStore) snapshotErr() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.snapErr
+}
+
+// pageWrite is a dirty page being written by a snapshot, along with the pages
+// it is split into should it have outgrown statePageBytes.
+type pageWrite struct {
+	page   *pageState
+	metas  []keyMeta
+	slot   int
+	stored bool
+	splits []*pageState
+}
+
+// snapshotState writes the pages changed since the last snapshot to their
+// free slots, then points the header at them. Changes keep being stored
+// meanwhile, the snapshot covers those made before it was taken.
+func (s *BalancerServer) snapshotState() (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), stateSnapshotTimeout)
+	defer cancel()
+
+	st := s.store
+	s.commitMu.Lock()
+	st.mu.Lock()
+	if !st.loaded {
+		st.mu.Unlock()
+		s.commitMu.Unlock()
+		return nil
+	}
+	var writes []*pageWrite
+	for i, p := range st.pages {
+		if !p.dirty {
+			continue
+		}
+		end := ""
+		if i+1 < len(st.pages) {
+			end = st.pages[i+1].first
+		}
+		writes = append(writes, &pageWrite{page: p, metas: s.index.metas(p.first, end)})
+		p.dirty = false
+	}
+	var leases map[int64]stateLease
+	leasesDirty := st.leasesDirty
+	if leasesDirty {
+		leases = s.leases.grants()
+		st.leasesDirty = false
+	}
+	h := &stateHeader{
+		Owner:      s.peers.self,
+		Epoch:      st.epoch,
+		Seq:        st.seq,
+		Revision:   s.index.revision(),
+		Complete:   st.complete,
+		LeaseSlot:  st.leaseSlot,
+		LeasePages: st.leasePages,
+	}
+	st.mu.Unlock()
+	s.commitMu.Unlock()
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		// what was not stored is left for the next snapshot
+		st.mu.Lock()
+		for _, w := range writes {
+			w.page.dirty = true
+		}
+		st.leasesDirty = st.leasesDirty || leasesDirty
+		st.mu.Unlock()
+	}()
+
+	for _, w := range writes {
+		if err := s.writePage(ctx, w); err != nil {
+			return err
+		}
+	}
+	if leasesDirty {
+		if h.LeaseSlot, h.LeasePages, err = s.writeLeases(ctx, 1-h.LeaseSlot, leases); err != nil {
+			return err
+		}
+	}
+
+	written := make(map[*pageState]*pageWrite, len(writes))
+	for _, w := range writes {
+		written[w.page] = w
+	}
+	st.mu.Lock()
+	for _, p := range st.pages {
+		if w, ok := written[p]; ok {
+			if w.stored {
+				h.Pages = append(h.Pages, statePage{ID: p.id, Slot: w.slot})
+			}
+			for _, sp := range w.splits {
+				h.Pages = append(h.Pages, statePage{ID: sp.id, Slot: sp.slot})
+			}
+		} else if p.stored {
+			h.Pages = append(h.Pages, statePage{ID: p.id, Slot: p.slot})
+		}
+	}
+	h.NextPage = st.nextPage
+	st.mu.Unlock()
+
+	if !s.IsCoordinator() {
+		return nil
+	}
+	if err := s.saveMeta(ctx, stateKey, h); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, w := range writes {
+		w.page.slot, w.page.stored = w.slot, w.stored
+		if len(w.splits) == 0 {
+			continue
+		}
+		// changes made since the copy were marked on the page they split from
+		for _, sp := range w.splits {
+			sp.dirty = w.page.dirty
+		}
+		i := sort.Search(len(st.pages), func(i int) bool { return st.pages[i].first > w.page.first })
+		st.pages = append(st.pages[:i], append(w.splits, st.pages[i:]...)...)
+	}
+	st.leaseSlot, st.leasePages = h.LeaseSlot, h.LeasePages
+	st.snapSeq = h.Seq
+	return nil
+}
+
+// writePage stores a dirty page to the slot its header entry does not point
+// at, splitting it into new pages once it outgrows statePageBytes. A page left
+// without keys is not stored.
+func (s *BalancerServer) writePage(ctx context.Context, w *pageWrite) error {
+	page := make([]stateKeyMeta, len(w.metas))
+	for i, m := range w.metas {
+		page[i] = stateKeyMeta{
+			Key:            m.key,
+			CreateRevision: m.createRevision,
+			ModRevision:    m.modRevision,
+			Version:        m.version,
+			Lease:          m.lease,
+		}
+	}
+	chunks, err := chunkBySize(page)
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	w.slot, w.stored = 0, true
+	if w.page.stored {
+		w.slot = 1 - w.page.slot
+	}
+	if err := s.saveMeta(ctx, statePageKey(w.page.id, w.slot), chunks[0]); err != nil {
+		return err
+	}
+	st := s.store
+	for _, chunk := range chunks[1:] {
+		st.mu.Lock()
+		sp := &pageState{id: st.nextPage, first: chunk[0].Key, stored: true}
+		st.nextPage++
+		st.mu.Unlock()
+		if err := s.saveMeta(ctx, statePageKey(sp.id, sp.slot), chunk); err != nil {
+			return err
+		}
+		w.splits = append(w.splits, sp)
+	}
+	return nil
+}
+
+// writeLeases stores every lease to slot, returning where they now are.
+func (s *BalancerServer) writeLeases(ctx context.Context, slot int, leases map[int64]stateLease) (int, int, error) {
+	entries := make([]stateLeaseEntry, 0, len(leases))
+	for id, l := range leases {
+		entries = append(entries, stateLeaseEntry{ID: id, stateLease: l})
+	}
+	chunks, err := chunkBySize(entries)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i, chunk := range chunks {
+		if err := s.saveMeta(ctx, stateLeaseKey(slot, i), chunk); err != nil {
+			return 0, 0, err
+		}
+	}
+	return slot, len(chunks), nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestChunkBySize(t *testing.T) {
+	small := make([]stateKeyMeta, 10)
+	for i := range small {
+		small[i] = stateKeyMeta{Key: strings.Repeat("k", i+1)}
+	}
+	big := make([]stateKeyMeta, 40)
+	for i := range big {
+		big[i] = stateKeyMeta{Key: strings.Repeat("k", statePageBytes/16) + string(rune('a'+i%26))}
+	}
+	huge := []stateKeyMeta{{Key: "a"}, {Key: strings.Repeat("h", 2*statePageBytes)}, {Key: "z"}}
+
+	tests := []struct {
+		name   string
+		items  []stateKeyMeta
+		chunks int
+	}{
+		{"empty", nil, 0},
+		{"one page", small, 1},
+		{"split by size", big, 3},
+		{"item larger than a page", huge, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks, err := chunkBySize(tt.items)
+			if err != nil {
+				t.Fatalf("chunkBySize() error = %v", err)
+			}
+			if len(chunks) != tt.chunks {
+				t.Fatalf("chunkBySize() made %d chunks, want %d", len(chunks), tt.chunks)
+			}
+			n := 0
+			for _, chunk := range chunks {
+				b, err := json.Marshal(chunk)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(b) > statePageBytes && len(chunk) > 1 {
+					t.Errorf("chunk of %d items is %d bytes, more than %d", len(chunk), len(b), statePageBytes)
+				}
+				for _, item := range chunk {
+					if item != tt.items[n] {
+						t.Fatalf("item %d is %q, want %q", n, item.Key, tt.items[n].Key)
+					}
+					n++
+				}
+			}
+			if n != len(tt.items) {
+				t.Errorf("chunks hold %d items, want %d", n, len(tt.items))
+			}
+		})
+	}
+}
+
+func TestMarkDirty(t *testing.T) {
+	pages := []*pageState{{id: 0}, {id: 1, first: "m"}, {id: 2, first: "t"}}
+	tests := []struct {
+		e      stateEntry
+		page   int
+		leases bool
+	}{
+		{stateEntry{Op: stateOpPut, Key: ""}, 0, false},
+		{stateEntry{Op: stateOpPut, Key: "a"}, 0, false},
+		{stateEntry{Op: stateOpDelete, Key: "m"}, 1, false},
+		{stateEntry{Op: stateOpTouch, Key: "s"}, 1, false},
+		{stateEntry{Op: stateOpPut, Key: "zz"}, 2, false},
+		{stateEntry{Op: stateOpGrant, Lease: 1}, -1, true},
+		{stateEntry{Op: stateOpRevoke, Lease: 1}, -1, true},
+		{stateEntry{Op: stateOpComplete}, -1, false},
+	}
+	for _, tt := range tests {
+		for _, p := range pages {
+			p.dirty = false
+		}
+		if leases := markDirty(pages, tt.e); leases != tt.leases {
+			t.Errorf("markDirty(%s %q) leases = %v, want %v", tt.e.Op, tt.e.Key, leases, tt.leases)
+		}
+		for i, p := range pages {
+			if p.dirty != (i == tt.page) {
+				t.Errorf("markDirty(%s %q) page %d dirty = %v", tt.e.Op, tt.e.Key, i, p.dirty)
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// tombstoneValue stands in for a deleted key. The worker release the agent
+// is built against panics on Delete, taking the leader down with it, so the
+// agent never calls it and overwrites keys with a tombstone instead. Clients
+// cannot store the tombstone themselves, see checkValue.
+const tombstoneValue = "\x00dinghy-deleted"
+
+// Delete overwrites the key with a tombstone rather than calling the worker's
+// Delete, see tombstoneValue.
+func (c *Client) Delete(ctx context.Context, in *workerApi.DeleteRequest, opts ...grpc.CallOption) (*workerApi.DeleteResponse, error) {
+	_, err := c.WorkerClient.Insert(ctx, &workerApi.InsertRequest{
+		Key:   in.Key,
+		Value: tombstoneValue,
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &workerApi.DeleteResponse{}, nil
+}
+
+// Fetch reports a tombstoned key as missing, just as the worker reports a key
+// it never held.
+func (c *Client) Fetch(ctx context.Context, in *workerApi.FetchRequest, opts ...grpc.CallOption) (*workerApi.FetchResponse, error) {
+	resp, err := c.WorkerClient.Fetch(ctx, in, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Value == tombstoneValue {
+		return nil, status.Error(codes.NotFound, "no records exist for the given key.")
+	}
+	return resp, nil
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+	workerApi "github.com/izaakdale/dinghy-worker/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// txnTimeout bounds the whole transaction, compares and ops included.
+const txnTimeout = 5 * time.Second
+
+// ErrUnknownRevision is returned when a compare needs the revisions of a key
+// the worker holds but the agent's index does not.
+var ErrUnknownRevision = errors.New("revisions of the key are unknown")
+
+// Txn evaluates the compares and applies either the success or failure ops to
+// the leaders of the shards the keys live on. Other writes through the agent
+// are held off for the duration so nothing can land between the compares and
+// the ops. Workers have no batch apply, so if an op fails part way the keys
+// already written are restored to their previous values before the error is
+// returned.
+func (s *BalancerServer) Txn(ctx context.Context, request *v1.TxnRequest) (*v1.TxnResponse, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, txnTimeout)
+	defer cancel()
+
+	leaderFor := s.txnLeaders(ctx)
+
+	succeeded := true
+	for _, c := range request.Compare {
+		ok, err := s.compare(ctx, leaderFor, c)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := request.Success
+	if !succeeded {
+		ops = request.Failure
+	}
+	responses, err := s.applyOps(ctx, leaderFor, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v1.TxnResponse{
+		Succeeded: succeeded,
+		Responses: responses,
+		Revision:  s.index.revision(),
+	}, nil
+}
+
+// txnLeaders returns a lookup of the leader owning a key, each shard's leader
+// is resolved once and kept for the rest of the transaction. A transaction is
+// not idempotent, so only finding the leaders is retried.
+func (s *BalancerServer) txnLeaders(ctx context.Context) func(key string) (*Client, error) {
+	leaders := make(map[string]*Client)
+	return func(key string) (*Client, error) {
+		if err := checkKey(key); err != nil {
+			return nil, err
+		}
+		shardID := s.keyShard(key)
+		if leader, ok := leaders[shardID]; ok {
+			return leader, nil
+		}
+		leader, err := s.leader(ctx, shardID)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("txn on %s served by %s\n", shardID, leader.ServerID)
+		leaders[shardID] = leader
+		return leader, nil
+	}
+}
+
+func (s *BalancerServer) compare(ctx context.Context, leaderFor func(string) (*Client, error), c *v1.Compare) (bool, error) {
+	var cmp int
+	switch c.Target {
+	case v1.Compare_VALUE, v1.Compare_EXISTS:
+		leader, err := leaderFor(c.Key)
+		if err != nil {
+			return false, err
+		}
+		val, ok, err := fetchValue(ctx, leader, c.Key)
+		if err != nil {
+			return false, err
+		}
+		if c.Target == v1.Compare_EXISTS {
+			if ok != c.GetExists() {
+				cmp = 1
+			}
+			break
+		}
+		// a missing key never matches a value compare
+		if !ok {
+			return false, nil
+		}
+		cmp = strings.Compare(val, c.GetValue())
+	default:
+		m, ok := s.index.get(c.Key)
+		if !ok {
+			// the key may predate the index, in which case comparing its
+			// revisions against zero would be wrong
+			leader, err := leaderFor(c.Key)
+			if err != nil {
+				return false, err
+			}
+			_, exists, err := fetchValue(ctx, leader, c.Key)
+			if err != nil {
+				return false, err
+			}
+			if exists {
+				return false, fmt.Errorf("%w: %s", ErrUnknownRevision, c.Key)
+			}
+		}
+		var have, want int64
+		switch c.Target {
+		case v1.Compare_VERSION:
+			have, want = m.version, c.GetVersion()
+		case v1.Compare_CREATE:
+			have, want = m.createRevision, c.GetCreateRevision()
+		case v1.Compare_MOD:
+			have, want = m.modRevision, c.GetModRevision()
+		default:
+			return false, fmt.Errorf("%w: unknown compare target %s", ErrInvalidRequest, c.Target)
+		}
+		switch {
+		case have < want:
+			cmp = -1
+		case have > want:
+			cmp = 1
+		}
+	}
+
+	switch c.Result {
+	case v1.Compare_EQUAL:
+		return cmp == 0, nil
+	case v1.Compare_NOT_EQUAL:
+		return cmp != 0, nil
+	case v1.Compare_GREATER:
+		return cmp > 0, nil
+	case v1.Compare_LESS:
+		return cmp < 0, nil
+	}
+	return false, fmt.Errorf("%w: unknown compare result %s", ErrInvalidRequest, c.Result)
+}
+
+// txnWrite is a write made by a transaction, along with what the key held
+// beforehand so it can be put back.
+type txnWrite struct {
+	leader  *Client
+	typ     v1.Event_EventType
+	key     string
+	value   string
+	lease   int64
+	prev    string
+	existed bool
+}
+
+func (s *BalancerServer) applyOps(ctx context.Context, leaderFor func(string) (*Client, error), ops []*v1.RequestOp) ([]*v1.ResponseOp, error) {
+	var (
+		responses []*v1.ResponseOp
+		written   []txnWrite
+	)
+	for _, op := range ops {
+		var (
+			resp   *v1.ResponseOp
+			w      *txnWrite
+			leader *Client
+			err    error
+		)
+		switch r := op.Request.(type) {
+		case *v1.RequestOp_RequestInsert:
+			w = &txnWrite{typ: v1.Event_PUT, key: r.RequestInsert.Key, value: r.RequestInsert.Value, lease: r.RequestInsert.Lease}
+			if err = checkValue(w.value); err != nil {
+				break
+			}
+			if w.lease != 0 && !s.leases.exists(w.lease) {
+				err = ErrLeaseNotFound
+				break
+			}
+			if leader, err = leaderFor(w.key); err != nil {
+				break
+			}
+			if err = s.track(ctx, w.key); err != nil {
+				break
+			}
+			if w.prev, w.existed, err = fetchValue(ctx, leader, w.key); err == nil {
+				_, err = leader.Insert(ctx, &workerApi.InsertRequest{Key: w.key, Value: w.value})
+			}
+			resp = &v1.ResponseOp{Response: &v1.ResponseOp_ResponseInsert{ResponseInsert: &v1.InsertResponse{}}}
+		case *v1.RequestOp_RequestDelete:
+			w = &txnWrite{typ: v1.Event_DELETE, key: r.RequestDelete.Key}
+			if leader, err = leaderFor(w.key); err != nil {
+				break
+			}
+			if w.prev, w.existed, err = fetchValue(ctx, leader, w.key); err == nil {
+				_, err = leader.Delete(ctx, &workerApi.DeleteRequest{Key: w.key})
+			}
+			resp = &v1.ResponseOp{Response: &v1.ResponseOp_ResponseDelete{ResponseDelete: &v1.DeleteResponse{}}}
+		case *v1.RequestOp_RequestFetch:
+			if leader, err = leaderFor(r.RequestFetch.Key); err != nil {
+				break
+			}
+			// a missing key gets an empty fetch response rather than failing
+			// the transaction
+			var (
+				val string
+				ok  bool
+			)
+			val, ok, err = fetchValue(ctx, leader, r.RequestFetch.Key)
+			if err == nil {
+				f := &v1.FetchResponse{}
+				if ok {
+					f.Key, f.Value = r.RequestFetch.Key, val
+				}
+				resp = &v1.ResponseOp{Response: &v1.ResponseOp_ResponseFetch{ResponseFetch: f}}
+			}
+		default:
+			err = fmt.Errorf("%w: unknown txn op %T", ErrInvalidRequest, op.Request)
+		}
+
+		if err != nil {
+			s.rollback(written)
+			return nil, err
+		}
+		if w != nil {
+			w.leader = leader
+			written = append(written, *w)
+		}
+		responses = append(responses, resp)
+	}
+
+	// only now that every op has landed do watchers get to see the writes
+	for _, w := range written {
+		if err := s.record(ctx, w.typ, w.key, w.value, w.lease); err != nil {
+			if errors.Is(err, ErrLeaseNotFound) {
+				s.dropUnleased(ctx, w.leader, w.key)
+			}
+			return nil, err
+		}
+	}
+	return responses, nil
+}
+
+// rollback undoes written in reverse order. It uses a fresh context since the
+// transaction context may be the reason we are rolling back.
+func (s *BalancerServer) rollback(written []txnWrite) {
+	ctx, cancel := context.WithTimeout(context.Background(), txnTimeout)
+	defer cancel()
+
+	for i := len(written) - 1; i >= 0; i-- {
+		w := written[i]
+		var err error
+		if w.existed {
+			_, err = w.leader.Insert(ctx, &workerApi.InsertRequest{Key: w.key, Value: w.prev})
+		} else {
+			_, err = w.leader.Delete(ctx, &workerApi.DeleteRequest{Key: w.key})
+		}
+		if err != nil {
+			log.Printf("failed to roll back txn write to %s: %v\n", w.key, err)
+		}
+	}
+}
+
+// fetchValue reads key from c, reporting whether it exists.
+func fetchValue(ctx context.Context, c *Client, key string) (string, bool, error) {
+	resp, err := c.Fetch(ctx, &workerApi.FetchRequest{
+		Key: key,
+	})
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return resp.Value, true, nil
+}
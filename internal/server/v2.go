@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"unicode/utf8"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+	v2 "github.com/izaakdale/dinghy-agent/api/v2"
+)
+
+// binaryValuePrefix marks values that have been base64 encoded on the way to
+// the workers, which can only store valid utf-8 strings.
+const binaryValuePrefix = "\x00dinghy-b64:"
+
+var _ v2.AgentServer = (*v2Server)(nil)
+
+// v2Server serves the v2 api on top of the same BalancerServer as v1, so both
+// versions share workers, the key index, watches and leases.
+type v2Server struct {
+	v2.UnimplementedAgentServer
+	s *BalancerServer
+}
+
+func (s *BalancerServer) V2() v2.AgentServer {
+	return &v2Server{s: s}
+}
+
+func (v *v2Server) Insert(ctx context.Context, request *v2.InsertRequest) (*v2.InsertResponse, error) {
+	if err := v.s.put(ctx, &v1.InsertRequest{
+		Key:   request.Key,
+		Value: encodeValue(request.Value),
+		Lease: request.Lease,
+	}); err != nil {
+		return nil, err
+	}
+	return &v2.InsertResponse{}, nil
+}
+
+func (v *v2Server) Delete(ctx context.Context, request *v2.DeleteRequest) (*v2.DeleteResponse, error) {
+	if _, err := v.s.Delete(ctx, &v1.DeleteRequest{
+		Key: request.Key,
+	}); err != nil {
+		return nil, err
+	}
+	return &v2.DeleteResponse{}, nil
+}
+
+func (v *v2Server) Fetch(ctx context.Context, request *v2.FetchRequest) (*v2.FetchResponse, error) {
+	resp, err := v.s.Fetch(ctx, &v1.FetchRequest{
+		Key:          request.Key,
+		Consistency:  v1.FetchRequest_Consistency(request.Consistency),
+		MaxStaleness: request.MaxStaleness,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &v2.FetchResponse{
+		Kv: v.s.keyValue(resp.Key, decodeValue(resp.Value)),
+	}, nil
+}
+
+func (v *v2Server) Range(request *v2.RangeRequest, stream v2.Agent_RangeServer) error {
+	return v.s.scan(stream.Context(), &v1.RangeRequest{
+		Key:       request.Key,
+		RangeEnd:  request.RangeEnd,
+		Prefix:    request.Prefix,
+		Limit:     request.Limit,
+		KeysOnly:  request.KeysOnly,
+		PageToken: request.PageToken,
+	}, func(kvs []*v1.KeyValue, nextPageToken string) error {
+		resp := &v2.RangeResponse{
+			Kvs:           make([]*v2.KeyValue, 0, len(kvs)),
+			NextPageToken: nextPageToken,
+			Partial:       !v.s.store.isComplete(),
+		}
+		for _, kv := range kvs {
+			var value []byte
+			if !request.KeysOnly {
+				value = decodeValue(kv.Value)
+			}
+			resp.Kvs = append(resp.Kvs, v.s.keyValue(kv.Key, value))
+		}
+		return stream.Send(resp)
+	})
+}
+
+// keyValue pairs a value with the metadata the agent holds for its key. Keys
+// the agent has not seen written report zeroed metadata.
+func (s *BalancerServer) keyValue(key string, value []byte) *v2.KeyValue {
+	m, _ := s.index.get(key)
+	return &v2.KeyValue{
+		Key:            key,
+		Value:          value,
+		CreateRevision: m.createRevision,
+		ModRevision:    m.modRevision,
+		Version:        m.version,
+		Lease:          m.lease,
+	}
+}
+
+// encodeValue stores utf-8 values as they are so v1 clients can still read
+// them, anything else is base64 encoded behind binaryValuePrefix. So is the
+// tombstone, which cannot be stored as it is.
+func encodeValue(b []byte) string {
+	if utf8.Valid(b) && !strings.HasPrefix(string(b), binaryValuePrefix) && string(b) != tombstoneValue {
+		return string(b)
+	}
+	return binaryValuePrefix + base64.StdEncoding.EncodeToString(b)
+}
+
+func decodeValue(s string) []byte {
+	if rest, ok := strings.CutPrefix(s, binaryValuePrefix); ok {
+		if b, err := base64.StdEncoding.DecodeString(rest); err == nil {
+			return b
+		}
+	}
+	return []byte(s)
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCheckValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"plain", "hello", true},
+		{"empty", "", true},
+		{"prefix inside", "hello" + binaryValuePrefix, true},
+		{"tombstone", tombstoneValue, false},
+		{"binary prefix", binaryValuePrefix + "aGVsbG8=", false},
+		{"binary prefix not base64", binaryValuePrefix + "not base64", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkValue(tt.value)
+			if tt.ok && err != nil {
+				t.Fatalf("checkValue() error = %v", err)
+			}
+			if !tt.ok && !errors.Is(err, ErrInvalidRequest) {
+				t.Fatalf("checkValue() error = %v, want %v", err, ErrInvalidRequest)
+			}
+		})
+	}
+}
+
+func TestEncodeValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+		plain bool
+	}{
+		{"utf-8", []byte("hello"), true},
+		{"empty", []byte{}, true},
+		{"binary", []byte{0xff, 0x00, 0xfe}, false},
+		{"tombstone", []byte(tombstoneValue), false},
+		{"binary prefix", []byte(binaryValuePrefix + "aGVsbG8="), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := encodeValue(tt.value)
+			if plain := enc == string(tt.value); plain != tt.plain {
+				t.Errorf("encodeValue() stored as it is = %v, want %v", plain, tt.plain)
+			}
+			if got := decodeValue(enc); !bytes.Equal(got, tt.value) {
+				t.Errorf("decodeValue(encodeValue()) = %q, want %q", got, tt.value)
+			}
+			// whatever v2 stores as it is, v1 may store too
+			if tt.plain {
+				if err := checkValue(enc); err != nil {
+					t.Errorf("checkValue() on a plain v2 value error = %v", err)
+				}
+			}
+		})
+	}
+}
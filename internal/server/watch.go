@@ -0,0 +1,175 @@
+package server
+
+import (
+	"sync"
+
+	v1 "github.com/izaakdale/dinghy-agent/api/v1"
+)
+
+const (
+	// watchHistorySize is the number of past events kept so watchers can resume.
+	watchHistorySize = 1024
+	// watcherBufferSize is the number of events a watcher can fall behind by
+	// before it is cancelled.
+	watcherBufferSize = 128
+)
+
+const (
+	cancelReasonCompacted = "required revision has been compacted"
+	cancelReasonSlow      = "watcher could not keep up with events"
+	cancelReasonLeader    = "leader changed, resume from the last seen revision"
+)
+
+// watchHub fans committed writes out to every watcher with a matching key
+// range and keeps a bounded history so watchers can resume from a revision.
+type watchHub struct {
+	mu       sync.Mutex
+	nextID   int64
+	watchers map[int64]*watcher
+	history  []*v1.Event
+	lastRev  int64
+}
+
+type watcher struct {
+	start, end string
+	events     chan *v1.Event
+	done       chan struct{}
+	once       sync.Once
+	reason     string
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[int64]*watcher),
+	}
+}
+
+func (w *watcher) cancel(reason string) {
+	w.once.Do(func() {
+		w.reason = reason
+		close(w.done)
+	})
+}
+
+// subscribe registers a watcher for [start, end) and returns the buffered
+// events it missed since startRev. If startRev is older than the retained
+// history the oldest available revision is returned as compactRev instead.
+func (h *watchHub) subscribe(start, end string, startRev int64) (id int64, w *watcher, backlog []*v1.Event, compactRev int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	oldest := h.lastRev + 1
+	if len(h.history) > 0 {
+		oldest = h.history[0].ModRevision
+	}
+	if startRev > 0 && startRev < oldest {
+		return 0, nil, nil, oldest
+	}
+	if startRev > 0 {
+		for _, e := range h.history {
+			if e.ModRevision >= startRev && inBounds(e.Kv.Key, start, end) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	h.nextID++
+	w = &watcher{
+		start:  start,
+		end:    end,
+		events: make(chan *v1.Event, watcherBufferSize),
+		done:   make(chan struct{}),
+	}
+	h.watchers[h.nextID] = w
+	return h.nextID, w, backlog, 0
+}
+
+func (h *watchHub) unsubscribe(id int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.watchers, id)
+}
+
+// publish never blocks, watchers that have fallen too far behind are cancelled.
+func (h *watchHub) publish(e *v1.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastRev = e.ModRevision
+	h.history = append(h.history, e)
+	if len(h.history) > watchHistorySize {
+		h.history = h.history[len(h.history)-watchHistorySize:]
+	}
+
+	for id, w := range h.watchers {
+		if !inBounds(e.Kv.Key, w.start, w.end) {
+			continue
+		}
+		select {
+		case w.events <- e:
+		default:
+			w.cancel(cancelReasonSlow)
+			delete(h.watchers, id)
+		}
+	}
+}
+
+// reset cancels every watcher and drops the history, so watchers resuming
+// from before rev learn it has been compacted.
+func (h *watchHub) reset(rev int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, w := range h.watchers {
+		w.cancel(cancelReasonLeader)
+		delete(h.watchers, id)
+	}
+	h.history, h.lastRev = nil, rev
+}
+
+func (h *watchHub) cancelAll(reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, w := range h.watchers {
+		w.cancel(reason)
+		delete(h.watchers, id)
+	}
+}
+
+func (s *BalancerServer) Watch(request *v1.WatchRequest, stream v1.Agent_WatchServer) error {
+	start, end := keyBounds(request.Key, request.RangeEnd, request.Prefix)
+
+	id, w, backlog, compactRev := s.watches.subscribe(start, end, request.StartRevision)
+	if compactRev != 0 {
+		return stream.Send(&v1.WatchResponse{
+			CompactRevision: compactRev,
+			Canceled:        true,
+			CancelReason:    cancelReasonCompacted,
+		})
+	}
+	defer s.watches.unsubscribe(id)
+
+	if len(backlog) > 0 {
+		if err := stream.Send(&v1.WatchResponse{Events: backlog}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-w.done:
+			return stream.Send(&v1.WatchResponse{
+				Canceled:     true,
+				CancelReason: w.reason,
+			})
+		case e := <-w.events:
+			if e.ModRevision < request.StartRevision {
+				continue
+			}
+			if err := stream.Send(&v1.WatchResponse{Events: []*v1.Event{e}}); err != nil {
+				return err
+			}
+		}
+	}
+}
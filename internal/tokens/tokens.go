@@ -0,0 +1,262 @@
+package tokens
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+const (
+	// leeway is the clock skew allowed when checking a token's times.
+	leeway = 30 * time.Second
+	// rootRole is never taken from a claim as it is, only through RoleMap.
+	rootRole = "root"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// Config says which tokens a Verifier accepts and how their claims map to
+// dinghy users and roles.
+type Config struct {
+	// JWKSFile is a JSON Web Key Set, any of its keys may sign tokens.
+	JWKSFile string
+	// KeyFiles are PEM encoded public keys, for issuers without a key set.
+	KeyFiles []string
+	// Issuer and Audience are checked when set.
+	Issuer   string
+	Audience string
+	// UserClaim names the user, sub when empty.
+	UserClaim string
+	// RolesClaim holds a role or a list of roles, roles when empty.
+	RolesClaim string
+	// RoleMap turns claim values into dinghy roles. Values missing from it
+	// are dropped when Strict, otherwise they are taken as role names. The
+	// root role is only ever granted through RoleMap.
+	RoleMap map[string]string
+	Strict  bool
+}
+
+// Claims is what a verified token says about its bearer.
+type Claims struct {
+	User  string
+	Roles []string
+}
+
+// Verifier checks bearer tokens against keys read from disk, reloading them
+// when the files change so issuers can rotate keys.
+type Verifier struct {
+	cfg Config
+
+	mu      sync.RWMutex
+	keys    []jose.JSONWebKey
+	modTime time.Time
+}
+
+// NewVerifier loads the keys named in cfg.
+func NewVerifier(cfg Config) (*Verifier, error) {
+	if cfg.JWKSFile == "" && len(cfg.KeyFiles) == 0 {
+		return nil, fmt.Errorf("no keys to verify tokens with")
+	}
+	if cfg.UserClaim == "" {
+		cfg.UserClaim = "sub"
+	}
+	if cfg.RolesClaim == "" {
+		cfg.RolesClaim = "roles"
+	}
+	v := &Verifier{cfg: cfg}
+	if err := v.load(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (v *Verifier) files() []string {
+	files := append([]string{}, v.cfg.KeyFiles...)
+	if v.cfg.JWKSFile != "" {
+		files = append(files, v.cfg.JWKSFile)
+	}
+	return files
+}
+
+func (v *Verifier) load() error {
+	modTime, err := latestModTime(v.files())
+	if err != nil {
+		return err
+	}
+
+	var keys []jose.JSONWebKey
+	if v.cfg.JWKSFile != "" {
+		b, err := os.ReadFile(v.cfg.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("failed to read key set: %w", err)
+		}
+		var set jose.JSONWebKeySet
+		if err := json.Unmarshal(b, &set); err != nil {
+			return fmt.Errorf("bad key set %s: %w", v.cfg.JWKSFile, err)
+		}
+		keys = append(keys, set.Keys...)
+	}
+	for _, f := range v.cfg.KeyFiles {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("failed to read key: %w", err)
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return fmt.Errorf("no pem block in %s", f)
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("bad key %s: %w", f, err)
+		}
+		keys = append(keys, jose.JSONWebKey{Key: pub})
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys in %s", strings.Join(v.files(), ", "))
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys, v.modTime = keys, modTime
+	return nil
+}
+
+func latestModTime(files []string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Run checks the key files for changes every interval until ctx is done. A
+// failed reload keeps the previous keys.
+func (v *Verifier) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		modTime, err := latestModTime(v.files())
+		if err != nil {
+			log.Printf("failed to check token keys: %v\n", err)
+			continue
+		}
+		v.mu.RLock()
+		changed := !modTime.Equal(v.modTime)
+		v.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := v.load(); err != nil {
+			log.Printf("failed to reload token keys, keeping the old ones: %v\n", err)
+			continue
+		}
+		log.Printf("reloaded token keys\n")
+	}
+}
+
+// Looks reports whether s is shaped like a signed JWT rather than an opaque token.
+func Looks(s string) bool {
+	return strings.Count(s, ".") == 2
+}
+
+// Verify checks a token's signature and claims. Tokens have to expire.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if len(tok.Headers) != 1 {
+		return Claims{}, fmt.Errorf("%w: expected one signature", ErrInvalidToken)
+	}
+	kid := tok.Headers[0].KeyID
+
+	v.mu.RLock()
+	keys := v.keys
+	v.mu.RUnlock()
+
+	var (
+		std jwt.Claims
+		raw map[string]interface{}
+	)
+	verified := false
+	for _, k := range keys {
+		if kid != "" && k.KeyID != "" && k.KeyID != kid {
+			continue
+		}
+		if k.Algorithm != "" && k.Algorithm != tok.Headers[0].Algorithm {
+			continue
+		}
+		if err := tok.Claims(k.Key, &std, &raw); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Claims{}, fmt.Errorf("%w: signature not made by a known key", ErrInvalidToken)
+	}
+
+	if std.Expiry == nil {
+		return Claims{}, fmt.Errorf("%w: no expiry", ErrInvalidToken)
+	}
+	expected := jwt.Expected{Issuer: v.cfg.Issuer}
+	if v.cfg.Audience != "" {
+		expected.Audience = jwt.Audience{v.cfg.Audience}
+	}
+	if err := std.ValidateWithLeeway(expected, leeway); err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	user, _ := raw[v.cfg.UserClaim].(string)
+	if user == "" {
+		return Claims{}, fmt.Errorf("%w: no %s claim", ErrInvalidToken, v.cfg.UserClaim)
+	}
+	return Claims{User: user, Roles: v.roles(raw[v.cfg.RolesClaim])}, nil
+}
+
+// roles maps the values of the roles claim to dinghy roles.
+func (v *Verifier) roles(claim interface{}) []string {
+	var values []string
+	switch c := claim.(type) {
+	case string:
+		values = strings.Fields(c)
+	case []interface{}:
+		for _, e := range c {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var roles []string
+	for _, val := range values {
+		if role, ok := v.cfg.RoleMap[val]; ok {
+			roles = append(roles, role)
+		} else if !v.cfg.Strict && val != rootRole {
+			roles = append(roles, val)
+		}
+	}
+	return roles
+}
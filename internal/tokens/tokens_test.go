@@ -0,0 +1,214 @@
+package tokens
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+const (
+	testIssuer   = "https://issuer.test"
+	testAudience = "dinghy"
+)
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writePublicKey stores the public half of key as a PEM file.
+func writePublicKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// writeKeySet stores the public half of key as a key set under kid.
+func writeKeySet(t *testing.T, key *ecdsa.PrivateKey, kid string) string {
+	t.Helper()
+	b, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &key.PublicKey,
+		KeyID:     kid,
+		Algorithm: string(jose.ES256),
+		Use:       "sig",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(f, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, kid string, claims ...interface{}) string {
+	t.Helper()
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if kid != "" {
+		opts = opts.WithHeader("kid", kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := jwt.Signed(signer)
+	for _, c := range claims {
+		b = b.Claims(c)
+	}
+	tok, err := b.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+// standard returns claims that pass the checks of a verifier built by newVerifier.
+func standard() jwt.Claims {
+	now := time.Now()
+	return jwt.Claims{
+		Subject:  "alice",
+		Issuer:   testIssuer,
+		Audience: jwt.Audience{testAudience},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+}
+
+func newVerifier(t *testing.T, cfg Config) *Verifier {
+	t.Helper()
+	cfg.Issuer, cfg.Audience = testIssuer, testAudience
+	v, err := NewVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVerify(t *testing.T) {
+	key, other := newKey(t), newKey(t)
+	v := newVerifier(t, Config{KeyFiles: []string{writePublicKey(t, key)}})
+
+	expired := standard()
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	noExpiry := standard()
+	noExpiry.Expiry = nil
+	wrongIssuer := standard()
+	wrongIssuer.Issuer = "https://elsewhere.test"
+	wrongAudience := standard()
+	wrongAudience.Audience = jwt.Audience{"someone-else"}
+	noSubject := standard()
+	noSubject.Subject = ""
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", sign(t, key, "", standard()), true},
+		{"wrong key", sign(t, other, "", standard()), false},
+		{"expired", sign(t, key, "", expired), false},
+		{"missing expiry", sign(t, key, "", noExpiry), false},
+		{"wrong issuer", sign(t, key, "", wrongIssuer), false},
+		{"wrong audience", sign(t, key, "", wrongAudience), false},
+		{"missing user", sign(t, key, "", noSubject), false},
+		{"not a jwt", "a.b.c", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := v.Verify(tt.token)
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("Verify() error = %v, want %v", err, ErrInvalidToken)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if c.User != "alice" {
+				t.Errorf("Verify() user = %q, want alice", c.User)
+			}
+		})
+	}
+}
+
+func TestVerifyKeySet(t *testing.T) {
+	key, other := newKey(t), newKey(t)
+	v := newVerifier(t, Config{JWKSFile: writeKeySet(t, key, "k1")})
+
+	if _, err := v.Verify(sign(t, key, "k1", standard())); err != nil {
+		t.Errorf("Verify() with the set's key error = %v", err)
+	}
+	if _, err := v.Verify(sign(t, key, "k2", standard())); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify() with an unknown kid error = %v, want %v", err, ErrInvalidToken)
+	}
+	if _, err := v.Verify(sign(t, other, "k1", standard())); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify() with another key under the set's kid error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	key := newKey(t)
+	keyFile := writePublicKey(t, key)
+	roleMap := map[string]string{
+		"kv-writers": "writer",
+		"kv-admins":  "root",
+	}
+
+	tests := []struct {
+		name   string
+		strict bool
+		roles  interface{}
+		want   []string
+	}{
+		{"mapped", true, []string{"kv-writers", "kv-admins"}, []string{"root", "writer"}},
+		{"strict drops unmapped", true, []string{"kv-writers", "readers"}, []string{"writer"}},
+		{"strict drops unmapped root", true, []string{"root"}, nil},
+		{"lenient keeps unmapped", false, []string{"kv-writers", "readers"}, []string{"readers", "writer"}},
+		{"lenient drops unmapped root", false, []string{"root", "readers"}, []string{"readers"}},
+		{"space separated", true, "kv-writers kv-admins", []string{"root", "writer"}},
+		{"missing", true, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVerifier(t, Config{KeyFiles: []string{keyFile}, RoleMap: roleMap, Strict: tt.strict})
+			extra := map[string]interface{}{}
+			if tt.roles != nil {
+				extra["roles"] = tt.roles
+			}
+			c, err := v.Verify(sign(t, key, "", standard(), extra))
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			sort.Strings(c.Roles)
+			if !reflect.DeepEqual(c.Roles, tt.want) {
+				t.Errorf("Verify() roles = %v, want %v", c.Roles, tt.want)
+			}
+		})
+	}
+}